@@ -17,8 +17,9 @@ import (
 )
 
 type stats struct {
-	PID statsPID `json:"pid"`
-	OS  statsOS  `json:"os"`
+	PID       statsPID       `json:"pid"`
+	OS        statsOS        `json:"os"`
+	RateLimit statsRateLimit `json:"rate_limit"`
 }
 
 type statsPID struct {
@@ -27,6 +28,11 @@ type statsPID struct {
 	Conns int     `json:"conns"`
 }
 
+type statsRateLimit struct {
+	Ws  controllers.RateLimitStats `json:"ws"`
+	Sse controllers.RateLimitStats `json:"sse"`
+}
+
 type statsOS struct {
 	CPU      float64 `json:"cpu"`
 	RAM      uint64  `json:"ram"`
@@ -85,6 +91,9 @@ func New() func(request *controllers.Request) {
 			data.OS.TotalRAM = OsTotalRam()
 			data.OS.LoadAvg = OsLoadAvg()
 			data.OS.Conns = OsConns()
+
+			data.RateLimit.Ws = controllers.WebsocketRateLimitStats()
+			data.RateLimit.Sse = controllers.SseRateLimitStats()
 			mutex.Unlock()
 
 			request.Writer.Header().Set("Content-Type", "application/json")
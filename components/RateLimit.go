@@ -0,0 +1,154 @@
+package components
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket allows Rate events per second with bursts up to Burst.
+type TokenBucket struct {
+	Rate   float64
+	Burst  float64
+	tokens float64
+	last   time.Time
+
+	mutex sync.Mutex
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &TokenBucket{
+		Rate:   rate,
+		Burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow takes a token. A bucket with a zero rate is unlimited.
+func (b *TokenBucket) Allow() bool {
+	if b == nil || b.Rate <= 0 {
+		return true
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+
+	b.tokens += now.Sub(b.last).Seconds() * b.Rate
+	if b.tokens > b.Burst {
+		b.tokens = b.Burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+
+	return true
+}
+
+// Refund gives back a token taken by Allow.
+func (b *TokenBucket) Refund() {
+	if b == nil || b.Rate <= 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.tokens++
+	if b.tokens > b.Burst {
+		b.tokens = b.Burst
+	}
+}
+
+func (b *TokenBucket) idle(now time.Time, ttl time.Duration) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return now.Sub(b.last) > ttl
+}
+
+// RateLimiter keeps a TokenBucket per key, for example per IP address.
+type RateLimiter struct {
+	Rate    float64
+	Burst   int
+	buckets map[string]*TokenBucket
+	cleanAt time.Time
+
+	mutex sync.Mutex
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		Rate:    rate,
+		Burst:   burst,
+		buckets: map[string]*TokenBucket{},
+		cleanAt: time.Now(),
+	}
+}
+
+func (l *RateLimiter) Allow(key string) bool {
+	if l == nil || l.Rate <= 0 {
+		return true
+	}
+
+	l.mutex.Lock()
+
+	now := time.Now()
+
+	// Forget the buckets that have been idle for a minute
+	if now.Sub(l.cleanAt) > time.Minute {
+		l.cleanAt = now
+
+		for k, b := range l.buckets {
+			if b.idle(now, time.Minute) {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = NewTokenBucket(l.Rate, l.Burst)
+		l.buckets[key] = b
+	}
+
+	l.mutex.Unlock()
+
+	return b.Allow()
+}
+
+// Refund gives back the token of the key taken by Allow.
+func (l *RateLimiter) Refund(key string) {
+	if l == nil || l.Rate <= 0 {
+		return
+	}
+
+	l.mutex.Lock()
+	b, ok := l.buckets[key]
+	l.mutex.Unlock()
+
+	if ok {
+		b.Refund()
+	}
+}
+
+// Delete forgets the bucket of the key, for example of a closed connection.
+func (l *RateLimiter) Delete(key string) {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	delete(l.buckets, key)
+}
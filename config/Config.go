@@ -3,6 +3,8 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,7 +19,91 @@ var (
 	PingPeriod = int64((PongWait * 9) / 10)
 
 	// Maximum message size allowed from peer.
-	MaxMessageSize = int64(512)
+	MaxMessageSize = int64(65536)
+
+	// I/O buffer sizes of the websocket upgrader.
+	WsReadBufferSize  = 1024
+	WsWriteBufferSize = 1024
+
+	// Negotiate permessage-deflate and compress with this flate level.
+	WsEnableCompression = false
+	WsCompressionLevel  = 1
+
+	// Size of the outbound queue of every websocket client.
+	WsSendQueueSize = 256
+
+	// What to do when the outbound queue is full: drop_oldest, drop_newest or disconnect.
+	WsSendQueuePolicy = "drop_oldest"
+
+	// Messages per second a websocket client may send and the burst above the rate, 0 is unlimited.
+	WsRate      = float64(0)
+	WsRateBurst = 20
+
+	// The same for all the websocket clients of one IP address.
+	WsRateIp      = float64(0)
+	WsRateIpBurst = 50
+
+	// What to do with a message over the limit: drop, warn or disconnect.
+	WsRatePolicy = "drop"
+
+	// Stacks (hub goroutines) started with a websocket. More are started when all of
+	// them have WsStackSize clients, up to WsMaxShards, 0 is enough for the max connections.
+	WsShards    = 4
+	WsMaxShards = 0
+	WsStackSize = uint64(5000)
+
+	// Keep the messages sent to all clients and to rooms for the clients
+	// that reconnect with ?since=<seq>, bounded by count and age.
+	WsReplayAll    = false
+	WsReplayRooms  = false
+	WsReplaySize   = 1000
+	WsReplayMaxAge = 5 * time.Minute
+
+	// Reconnection delay suggested to the clients closed by a shutdown.
+	DrainRetry = 3 * time.Second
+
+	// Limits of the messages posted to /sse/message.
+	SseRate        = float64(0)
+	SseRateBurst   = 20
+	SseRateIp      = float64(0)
+	SseRateIpBurst = 50
+	SseRatePolicy  = "drop"
+
+	// Keep the events sent to all clients and to every client for the
+	// EventSource reconnecting with Last-Event-ID, bounded by count and age.
+	SseHistorySize   = 1000
+	SseHistoryMaxAge = 5 * time.Minute
+
+	// Lifetime of the client tokens of /sse/message, a reconnect issues a new one.
+	SseTokenTtl = 24 * time.Hour
+
+	// Origins allowed to call the HTTP, SSE and WebSocket routes from other
+	// sites: "*" or a list like https://app.example.com,https://*.example.com.
+	// Without them only the same origin is allowed, but the SSE servers of
+	// SSE_PORT and SSES_PORT allow any origin. The deprecated WS_CHECK_ORIGN
+	// is used when CORS_ORIGINS is not set, "true" is "*".
+	CorsOrigins     = []string{}
+	CorsMethods     = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	CorsHeaders     = []string{"Content-Type", "Authorization", "X-Requested-With", "Last-Event-ID"}
+	CorsCredentials = false
+	CorsMaxAge      = 600
+
+	// A WebRTC camera room without publishers and viewers is closed after this.
+	WebrtcRoomEmptyTimeout = 60 * time.Second
+
+	// The number of WebRTC camera rooms of the node, 0 for no limit. Only the
+	// authorized users create rooms, the guests publish into the existing ones.
+	WebrtcRoomMax = 100
+
+	// ICE servers of the WebRTC sessions, the same for the server and the
+	// browsers: stun:, turn: and turns: urls, empty for none. The username and
+	// the credential are of the turn urls.
+	WebrtcIceServers    = []string{"stun:stun.l.google.com:19302"}
+	WebrtcIceUsername   = ""
+	WebrtcIceCredential = ""
+
+	// Lifetime of the TURN credentials issued with TURN_SERVER_SECRET.
+	TurnCredentialTtl = 24 * time.Hour
 )
 
 type Config struct{}
@@ -28,6 +114,53 @@ func Env(key string) string {
 	return os.Getenv(key)
 }
 
+// EnvInt returns the integer environment variable key or the default.
+func EnvInt(key string, dfault int) int {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return n
+	}
+
+	return dfault
+}
+
+// EnvFloat returns the float environment variable key or the default.
+func EnvFloat(key string, dfault float64) float64 {
+	if n, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return n
+	}
+
+	return dfault
+}
+
+// EnvList returns the comma separated environment variable key or the default.
+func EnvList(key string, dfault []string) []string {
+	if os.Getenv(key) == "" {
+		return dfault
+	}
+
+	list := []string{}
+
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			list = append(list, value)
+		}
+	}
+
+	return list
+}
+
+// EnvBool returns true for "true" or "1", false for "false" or "0", otherwise the default.
+func EnvBool(key string, dfault bool) bool {
+	switch os.Getenv(key) {
+	case "true", "1":
+		return true
+	case "false", "0":
+		return false
+	}
+
+	return dfault
+}
+
 // GetEnv retrieves the environment variable key. If it does not exist it returns the default.
 func GetEnv(key string, dfault string, combineWith ...string) string {
 	value := os.Getenv(key)
@@ -0,0 +1,185 @@
+package controllers
+
+import (
+	"backnet/components"
+	"backnet/config"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	BackplaneActionAll     = "all"
+	BackplaneActionKey     = "key"
+	BackplaneActionRoom    = "room"
+	BackplaneActionUser    = "user"
+	BackplaneActionChannel = "channel"
+)
+
+// BackplaneMessage is a send relayed between FastFire nodes.
+type BackplaneMessage struct {
+	Node        string
+	Transport   string
+	Hub         string
+	Action      string
+	Key         string
+	Event       string
+	MessageType int
+	Data        []byte
+
+	// The reconnection delay of the SSE events, in milliseconds
+	Retry int64
+}
+
+// Backplane connects the nodes of a cluster. Publish must deliver the message
+// to the subscribers of every node, the node itself included.
+type Backplane interface {
+	Publish(*BackplaneMessage) error
+	Subscribe(func(*BackplaneMessage))
+	Close() error
+}
+
+type backplaneStruct struct {
+	backplane Backplane
+	node      string
+	handlers  map[string]func(*BackplaneMessage)
+
+	mutex sync.RWMutex
+}
+
+var backplaneApp backplaneStruct
+
+func NewBackplaneMessage(transport string, action string, key string, messageType int, message any) *BackplaneMessage {
+	bpMessage := &BackplaneMessage{
+		Transport:   transport,
+		Action:      action,
+		Key:         key,
+		MessageType: messageType,
+	}
+
+	components.СonvertAssign(&bpMessage.Data, message)
+
+	return bpMessage
+}
+
+// BackplaneStart creates the backplane selected by BACKPLANE_DRIVER. The tcp
+// driver needs BACKPLANE_SECRET, a peer without it could send to every client.
+func BackplaneStart() error {
+	var bp Backplane
+
+	switch config.Env("BACKPLANE_DRIVER") {
+	case "":
+		return nil
+	case "memory":
+		bp = NewBackplaneMemory()
+	case "tcp":
+		if config.Env("BACKPLANE_SECRET") == "" {
+			return fmt.Errorf("BACKPLANE_SECRET is required by the tcp backplane")
+		}
+
+		peers := []string{}
+
+		for _, peer := range strings.Split(config.Env("BACKPLANE_PEERS"), ",") {
+			if strings.TrimSpace(peer) != "" {
+				peers = append(peers, strings.TrimSpace(peer))
+			}
+		}
+
+		bpTcp := NewBackplaneTcp(config.Env("BACKPLANE_LISTEN"), peers, config.Env("BACKPLANE_SECRET"))
+
+		if err := bpTcp.Run(); err != nil {
+			return err
+		}
+
+		bp = bpTcp
+	default:
+		return fmt.Errorf("Error Select Driver Backplane")
+	}
+
+	SetBackplane(bp)
+
+	return nil
+}
+
+func SetBackplane(bp Backplane) {
+	backplaneApp.mutex.Lock()
+	defer backplaneApp.mutex.Unlock()
+
+	if backplaneApp.node == "" {
+		backplaneApp.node = config.Env("BACKPLANE_NODE")
+	}
+
+	if backplaneApp.node == "" {
+		hostname, _ := os.Hostname()
+		backplaneApp.node = fmt.Sprintf("%s:%d:%s", hostname, os.Getpid(), components.RandString(10))
+	}
+
+	backplaneApp.backplane = bp
+
+	if bp != nil {
+		bp.Subscribe(backplaneApp.receive)
+	}
+}
+
+func BackplaneNode() string {
+	backplaneApp.mutex.RLock()
+	defer backplaneApp.mutex.RUnlock()
+
+	return backplaneApp.node
+}
+
+// BackplaneHandle registers the local delivery of messages of the transport.
+func BackplaneHandle(transport string, handler func(*BackplaneMessage)) {
+	backplaneApp.mutex.Lock()
+	defer backplaneApp.mutex.Unlock()
+
+	if backplaneApp.handlers == nil {
+		backplaneApp.handlers = map[string]func(*BackplaneMessage){}
+	}
+
+	backplaneApp.handlers[transport] = handler
+}
+
+func BackplanePublish(bpMessage *BackplaneMessage) {
+	backplaneApp.mutex.RLock()
+	bp := backplaneApp.backplane
+	bpMessage.Node = backplaneApp.node
+	backplaneApp.mutex.RUnlock()
+
+	if bp == nil {
+		return
+	}
+
+	if err := bp.Publish(bpMessage); err != nil {
+		log.Println(err)
+	}
+}
+
+func BackplaneClose() {
+	backplaneApp.mutex.Lock()
+	bp := backplaneApp.backplane
+	backplaneApp.backplane = nil
+	backplaneApp.mutex.Unlock()
+
+	if bp != nil {
+		bp.Close()
+	}
+}
+
+func (bpApp *backplaneStruct) receive(bpMessage *BackplaneMessage) {
+	bpApp.mutex.RLock()
+	handler, ok := bpApp.handlers[bpMessage.Transport]
+	node := bpApp.node
+	bpApp.mutex.RUnlock()
+
+	// The node has already delivered its own messages
+	if bpMessage.Node == node {
+		return
+	}
+
+	if ok {
+		handler(bpMessage)
+	}
+}
@@ -0,0 +1,69 @@
+package controllers
+
+import (
+	"errors"
+	"sync"
+)
+
+// BackplaneMemory relays messages inside one process. Every node of the
+// process subscribes to the same instance.
+type BackplaneMemory struct {
+	Mutex       sync.RWMutex
+	Messages    chan *BackplaneMessage
+	Subscribers []func(*BackplaneMessage)
+	Done        chan struct{}
+	closeOnce   sync.Once
+}
+
+func NewBackplaneMemory() *BackplaneMemory {
+	bp := &BackplaneMemory{
+		Messages:    make(chan *BackplaneMessage, 1024),
+		Subscribers: []func(*BackplaneMessage){},
+		Done:        make(chan struct{}),
+	}
+
+	go bp.run()
+
+	return bp
+}
+
+func (bp *BackplaneMemory) run() {
+	for {
+		select {
+		case bpMessage := <-bp.Messages:
+			bp.Mutex.RLock()
+			subscribers := bp.Subscribers
+			bp.Mutex.RUnlock()
+
+			for _, subscriber := range subscribers {
+				subscriber(bpMessage)
+			}
+		case <-bp.Done:
+			return
+		}
+	}
+}
+
+func (bp *BackplaneMemory) Publish(bpMessage *BackplaneMessage) error {
+	select {
+	case <-bp.Done:
+		return errors.New("backplane is closed")
+	case bp.Messages <- bpMessage:
+		return nil
+	}
+}
+
+func (bp *BackplaneMemory) Subscribe(subscriber func(*BackplaneMessage)) {
+	bp.Mutex.Lock()
+	defer bp.Mutex.Unlock()
+
+	bp.Subscribers = append(bp.Subscribers, subscriber)
+}
+
+func (bp *BackplaneMemory) Close() error {
+	bp.closeOnce.Do(func() {
+		close(bp.Done)
+	})
+
+	return nil
+}
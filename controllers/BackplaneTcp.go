@@ -0,0 +1,217 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const backplaneTcpHello = "hello"
+
+// BackplaneTcp is a full mesh: every node listens for its peers and dials
+// every peer from BACKPLANE_PEERS. A node only sends its own messages, so
+// nothing is forwarded twice.
+//
+// The connections are plain TCP: the secret of the hello and the messages
+// travel unencrypted, so the peers have to be on a private network or a tunnel.
+type BackplaneTcp struct {
+	Mutex       sync.RWMutex
+	Listen      string
+	Peers       map[string]*backplaneTcpPeer
+	Secret      string
+	Listener    net.Listener
+	Subscribers []func(*BackplaneMessage)
+	Done        chan struct{}
+	closeOnce   sync.Once
+}
+
+type backplaneTcpPeer struct {
+	Addr     string
+	Messages chan *BackplaneMessage
+}
+
+func NewBackplaneTcp(listen string, peers []string, secret string) *BackplaneTcp {
+	bp := &BackplaneTcp{
+		Listen:      listen,
+		Peers:       map[string]*backplaneTcpPeer{},
+		Secret:      secret,
+		Subscribers: []func(*BackplaneMessage){},
+		Done:        make(chan struct{}),
+	}
+
+	for _, addr := range peers {
+		bp.Peers[addr] = &backplaneTcpPeer{
+			Addr:     addr,
+			Messages: make(chan *BackplaneMessage, 1024),
+		}
+	}
+
+	return bp
+}
+
+func (bp *BackplaneTcp) Run() error {
+	if bp.Listen != "" {
+		listener, err := net.Listen("tcp", bp.Listen)
+		if err != nil {
+			return err
+		}
+
+		bp.Listener = listener
+
+		go bp.accept()
+	}
+
+	for _, peer := range bp.Peers {
+		go bp.runPeer(peer)
+	}
+
+	return nil
+}
+
+func (bp *BackplaneTcp) accept() {
+	for {
+		conn, err := bp.Listener.Accept()
+		if err != nil {
+			select {
+			case <-bp.Done:
+				return
+			default:
+			}
+
+			log.Println(err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		go bp.serve(conn)
+	}
+}
+
+func (bp *BackplaneTcp) serve(conn net.Conn) {
+	defer conn.Close()
+
+	go func() {
+		<-bp.Done
+		conn.Close()
+	}()
+
+	decoder := json.NewDecoder(conn)
+
+	hello := &BackplaneMessage{}
+	if err := decoder.Decode(hello); err != nil {
+		return
+	}
+
+	if hello.Action != backplaneTcpHello || bp.Secret == "" || subtle.ConstantTimeCompare([]byte(hello.Key), []byte(bp.Secret)) != 1 {
+		log.Println("backplane: rejected peer", conn.RemoteAddr())
+		return
+	}
+
+	for {
+		bpMessage := &BackplaneMessage{}
+		if err := decoder.Decode(bpMessage); err != nil {
+			return
+		}
+
+		bp.deliver(bpMessage)
+	}
+}
+
+func (bp *BackplaneTcp) runPeer(peer *backplaneTcpPeer) {
+	for {
+		select {
+		case <-bp.Done:
+			return
+		default:
+		}
+
+		conn, err := net.DialTimeout("tcp", peer.Addr, 5*time.Second)
+		if err != nil {
+			select {
+			case <-bp.Done:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		bp.writePeer(peer, conn)
+
+		conn.Close()
+	}
+}
+
+func (bp *BackplaneTcp) writePeer(peer *backplaneTcpPeer, conn net.Conn) {
+	encoder := json.NewEncoder(conn)
+
+	if err := encoder.Encode(&BackplaneMessage{Action: backplaneTcpHello, Key: bp.Secret}); err != nil {
+		return
+	}
+
+	for {
+		select {
+		case bpMessage := <-peer.Messages:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+
+			if err := encoder.Encode(bpMessage); err != nil {
+				log.Println("backplane:", peer.Addr, err)
+				return
+			}
+		case <-bp.Done:
+			return
+		}
+	}
+}
+
+func (bp *BackplaneTcp) deliver(bpMessage *BackplaneMessage) {
+	bp.Mutex.RLock()
+	subscribers := bp.Subscribers
+	bp.Mutex.RUnlock()
+
+	for _, subscriber := range subscribers {
+		subscriber(bpMessage)
+	}
+}
+
+func (bp *BackplaneTcp) Publish(bpMessage *BackplaneMessage) error {
+	select {
+	case <-bp.Done:
+		return errors.New("backplane is closed")
+	default:
+	}
+
+	for _, peer := range bp.Peers {
+		select {
+		case peer.Messages <- bpMessage:
+		default:
+			log.Println("backplane: queue of peer is full", peer.Addr)
+		}
+	}
+
+	bp.deliver(bpMessage)
+
+	return nil
+}
+
+func (bp *BackplaneTcp) Subscribe(subscriber func(*BackplaneMessage)) {
+	bp.Mutex.Lock()
+	defer bp.Mutex.Unlock()
+
+	bp.Subscribers = append(bp.Subscribers, subscriber)
+}
+
+func (bp *BackplaneTcp) Close() error {
+	bp.closeOnce.Do(func() {
+		close(bp.Done)
+
+		if bp.Listener != nil {
+			bp.Listener.Close()
+		}
+	})
+
+	return nil
+}
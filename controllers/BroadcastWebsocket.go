@@ -2,23 +2,46 @@ package controllers
 
 import (
 	"backnet/components"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 type BroadcastWebsocket struct {
-	WsKey     uint64
-	StackKey  uint64
-	ClientKey uint64
-	Message   []byte
+	WsKey       uint64
+	StackKey    uint64
+	ClientKey   uint64
+	Room        string
+	MessageType int
+	Message     []byte
+
+	// Sequence number and time of a message kept for replay, 0 if it is not
+	Seq  uint64
+	Time time.Time
 }
 
 func NewBroadcastWebsocket(wsKey uint64, stackKey uint64, clientKey uint64, message any) *BroadcastWebsocket {
 	wsBroadcast := &BroadcastWebsocket{
-		WsKey:     wsKey,
-		StackKey:  stackKey,
-		ClientKey: clientKey,
+		WsKey:       wsKey,
+		StackKey:    stackKey,
+		ClientKey:   clientKey,
+		MessageType: websocket.TextMessage,
 	}
 
 	components.СonvertAssign(&wsBroadcast.Message, message)
 
 	return wsBroadcast
 }
+
+func NewBroadcastRoomWebsocket(room string, message any) *BroadcastWebsocket {
+	wsBroadcast := NewBroadcastWebsocket(0, 0, 0, message)
+	wsBroadcast.Room = room
+
+	return wsBroadcast
+}
+
+func (wsBroadcast *BroadcastWebsocket) Binary() *BroadcastWebsocket {
+	wsBroadcast.MessageType = websocket.BinaryMessage
+
+	return wsBroadcast
+}
@@ -0,0 +1,36 @@
+package controllers
+
+// Connection is a client of one of the realtime transports: a websocket
+// client, an SSE stream with its /sse/message posts or a WebRTC data channel.
+type Connection interface {
+	Key() string
+
+	// ws, sse or webrtc
+	Transport() string
+
+	// Id of the authorized models.User, 0 for guests
+	User() uint64
+
+	// SendMessage sends the message to this client. It is false when the client is gone.
+	SendMessage(message any) bool
+
+	// SendAll sends the message to all the clients of the transport, on every node.
+	SendAll(message any)
+
+	Close()
+}
+
+// ConnectionHandler is the application logic of the realtime clients. One
+// handler is served over every transport it is registered with:
+// Websocket.Handle, ApiSse.Handle and webrtc.WebrtcHandle.
+type ConnectionHandler interface {
+	OnConnect(Connection)
+	OnMessage(Connection, []byte)
+	OnClose(Connection)
+}
+
+// ConnectionBinaryHandler is a ConnectionHandler that takes the binary frames
+// of the websocket clients, without it they are not passed to OnMessage.
+type ConnectionBinaryHandler interface {
+	OnBinaryMessage(Connection, []byte)
+}
@@ -0,0 +1,96 @@
+package controllers
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConnectionInfo describes an open realtime connection of this node.
+type ConnectionInfo struct {
+	Transport string    `json:"transport"`
+	Key       string    `json:"key"`
+	Ip        string    `json:"ip"`
+	UserId    uint64    `json:"user_id"`
+	ConnectAt time.Time `json:"connect_at"`
+	ActiveAt  time.Time `json:"active_at"`
+}
+
+// ConnectionsProvider lists and controls the connections of one transport.
+type ConnectionsProvider struct {
+	List       func() []*ConnectionInfo
+	Disconnect func(key string) bool
+	Send       func(key string, message string) bool
+}
+
+type connectionsStruct struct {
+	providers map[string]*ConnectionsProvider
+
+	mutex sync.RWMutex
+}
+
+var connectionsApp connectionsStruct
+
+// ConnectionsHandle registers the provider of the transport, the prefix of its keys.
+func ConnectionsHandle(transport string, provider *ConnectionsProvider) {
+	connectionsApp.mutex.Lock()
+	defer connectionsApp.mutex.Unlock()
+
+	if connectionsApp.providers == nil {
+		connectionsApp.providers = map[string]*ConnectionsProvider{}
+	}
+
+	connectionsApp.providers[transport] = provider
+}
+
+func connectionsProvider(transport string) (*ConnectionsProvider, bool) {
+	connectionsApp.mutex.RLock()
+	defer connectionsApp.mutex.RUnlock()
+
+	provider, ok := connectionsApp.providers[transport]
+
+	return provider, ok
+}
+
+// ConnectionsList returns the connections of the transport, all of them for "".
+func ConnectionsList(transport string) []*ConnectionInfo {
+	connectionsApp.mutex.RLock()
+	providers := map[string]*ConnectionsProvider{}
+
+	for name, provider := range connectionsApp.providers {
+		if transport == "" || transport == name {
+			providers[name] = provider
+		}
+	}
+	connectionsApp.mutex.RUnlock()
+
+	connections := []*ConnectionInfo{}
+
+	for _, provider := range providers {
+		connections = append(connections, provider.List()...)
+	}
+
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].ConnectAt.Before(connections[j].ConnectAt)
+	})
+
+	return connections
+}
+
+// ConnectionDisconnect closes the connection with the key, for example "ws:1:2:3".
+func ConnectionDisconnect(key string) bool {
+	if provider, ok := connectionsProvider(strings.Split(key, ":")[0]); ok {
+		return provider.Disconnect(key)
+	}
+
+	return false
+}
+
+func ConnectionSend(key string, message string) bool {
+	if provider, ok := connectionsProvider(strings.Split(key, ":")[0]); ok {
+		return provider.Send(key, message)
+	}
+
+	return false
+}
@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"backnet/config"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Cors is the origin policy of the HTTP, WebSocket and SSE routes. An origin
+// is allowed when it is in Origins, "*" allows any origin without the
+// credentials and "https://*.example.com" any subdomain.
+type Cors struct {
+	Origins     []string
+	Methods     []string
+	Headers     []string
+	Credentials bool
+
+	// Seconds the browser caches a preflight response
+	MaxAge int
+}
+
+type corsStruct struct {
+	cors  *Cors
+	mutex sync.Mutex
+}
+
+var corsApp corsStruct
+
+func NewCors(origins []string, methods []string, headers []string, credentials bool, maxAge int) *Cors {
+	return &Cors{
+		Origins:     origins,
+		Methods:     methods,
+		Headers:     headers,
+		Credentials: credentials,
+		MaxAge:      maxAge,
+	}
+}
+
+// CorsPolicy returns the policy of the CORS_* settings.
+func CorsPolicy() *Cors {
+	corsApp.mutex.Lock()
+	defer corsApp.mutex.Unlock()
+
+	if corsApp.cors == nil {
+		corsApp.cors = NewCors(config.CorsOrigins, config.CorsMethods, config.CorsHeaders, config.CorsCredentials, config.CorsMaxAge)
+	}
+
+	return corsApp.cors
+}
+
+func (cors *Cors) anyOrigin() bool {
+	for _, allowed := range cors.Origins {
+		if allowed == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (cors *Cors) AllowOrigin(origin string) bool {
+	for _, allowed := range cors.Origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+
+		if i := strings.Index(allowed, "://*."); i >= 0 {
+			if strings.HasPrefix(origin, allowed[:i+3]) && strings.HasSuffix(origin, allowed[i+4:]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// CheckOrigin is the origin check of the websocket upgrader: a request of the
+// same host or without Origin is allowed, otherwise the origin has to be allowed.
+func (cors *Cors) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+
+	if origin == "" {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	return cors.AllowOrigin(origin)
+}
+
+// Handler adds the CORS headers for the allowed origins and answers the preflight requests.
+func (cors *Cors) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+
+		if origin != "" && cors.AllowOrigin(origin) {
+			header := w.Header()
+			header.Add("Vary", "Origin")
+
+			// The credentials are never allowed to any origin
+			if cors.anyOrigin() {
+				header.Set("Access-Control-Allow-Origin", "*")
+			} else {
+				header.Set("Access-Control-Allow-Origin", origin)
+
+				if cors.Credentials {
+					header.Set("Access-Control-Allow-Credentials", "true")
+				}
+			}
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				header.Set("Access-Control-Allow-Methods", strings.Join(cors.Methods, ", "))
+				header.Set("Access-Control-Allow-Headers", strings.Join(cors.Headers, ", "))
+
+				if cors.MaxAge > 0 {
+					header.Set("Access-Control-Max-Age", strconv.Itoa(cors.MaxAge))
+				}
+
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,108 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"backnet/config"
+)
+
+// Event and close reason that ask the clients to reconnect to another node.
+const DrainReconnect = "reconnect"
+
+type drainStruct struct {
+	draining int32
+	handlers map[string]func(context.Context)
+
+	mutex sync.Mutex
+}
+
+var drainApp drainStruct
+
+// DrainHandle registers the closing of the connections of the transport.
+// The handler should return when its connections are closed or the context is done.
+func DrainHandle(transport string, handler func(context.Context)) {
+	drainApp.mutex.Lock()
+	defer drainApp.mutex.Unlock()
+
+	if drainApp.handlers == nil {
+		drainApp.handlers = map[string]func(context.Context){}
+	}
+
+	drainApp.handlers[transport] = handler
+}
+
+func Draining() bool {
+	return atomic.LoadInt32(&drainApp.draining) == 1
+}
+
+// Drain stops new realtime connections and closes the open ones of all
+// transports. It returns when they are closed or the context is done.
+func Drain(ctx context.Context) {
+	if !atomic.CompareAndSwapInt32(&drainApp.draining, 0, 1) {
+		return
+	}
+
+	drainApp.mutex.Lock()
+	handlers := make([]func(context.Context), 0, len(drainApp.handlers))
+
+	for _, handler := range drainApp.handlers {
+		handlers = append(handlers, handler)
+	}
+	drainApp.mutex.Unlock()
+
+	var wg sync.WaitGroup
+
+	for _, handler := range handlers {
+		wg.Add(1)
+
+		go func(handler func(context.Context)) {
+			defer wg.Done()
+
+			handler(ctx)
+		}(handler)
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// DrainGuard answers 503 instead of opening a new connection while draining.
+func DrainGuard(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if Draining() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(config.DrainRetry/time.Second)))
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// drainWait polls count until it is zero or the context is done.
+func drainWait(ctx context.Context, count func() uint64) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for count() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package controllers
+
+import (
+	"backnet/components"
+	"backnet/config"
+	"backnet/models"
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	PresenceJoin  = "presence.join"
+	PresenceLeave = "presence.leave"
+
+	PresenceTransportWs     = "ws"
+	PresenceTransportSse    = "sse"
+	PresenceTransportWebrtc = "webrtc"
+)
+
+type PresenceEvent struct {
+	Event     string
+	UserId    uint64
+	Transport string
+	Key       string
+	Time      time.Time
+}
+
+type presenceStruct struct {
+	// user -> transport -> connection keys
+	users     map[uint64]map[string]map[string]bool
+	dirty     map[uint64]bool
+	listeners map[string][]func(*PresenceEvent)
+	valid     bool
+
+	// The events are queued under the mutex and emitted in that order
+	events    []*PresenceEvent
+	eventChan chan struct{}
+
+	mutex sync.Mutex
+}
+
+var presenceApp presenceStruct
+
+func (p *presenceStruct) presence() *presenceStruct {
+	if !p.valid {
+		p.users = map[uint64]map[string]map[string]bool{}
+		p.dirty = map[uint64]bool{}
+		p.listeners = map[string][]func(*PresenceEvent){}
+		p.eventChan = make(chan struct{}, 1)
+		p.valid = true
+
+		interval := 30 * time.Second
+
+		if n, err := strconv.Atoi(config.Env("PRESENCE_FLUSH_INTERVAL")); err == nil && n > 0 {
+			interval = time.Duration(n) * time.Second
+		}
+
+		go p.run(interval)
+		go p.emitter()
+
+		DrainHandle("presence", p.drain)
+	}
+
+	return p
+}
+
+// run writes OnlineAt of the online and the just disconnected users
+// once per interval instead of on every connect.
+func (p *presenceStruct) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.flush()
+	}
+}
+
+func (p *presenceStruct) flush() {
+	p.mutex.Lock()
+	ids := make([]uint64, 0, len(p.dirty)+len(p.users))
+
+	for userId, _ := range p.dirty {
+		ids = append(ids, userId)
+	}
+
+	for userId, _ := range p.users {
+		if _, ok := p.dirty[userId]; !ok {
+			ids = append(ids, userId)
+		}
+	}
+
+	p.dirty = map[uint64]bool{}
+	p.mutex.Unlock()
+
+	if len(ids) == 0 {
+		return
+	}
+
+	db, err := components.DB()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if err := db.Model(models.NewUser()).Where("id IN ?", ids).Update("online_at", time.Now()).Error; err != nil {
+		log.Println(err)
+	}
+}
+
+// drain writes OnlineAt of the users disconnected by the transports before the exit.
+func (p *presenceStruct) drain(ctx context.Context) {
+	drainWait(ctx, func() uint64 {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		return uint64(len(p.users))
+	})
+
+	p.flush()
+}
+
+// emit queues the event. The mutex is held.
+func (p *presenceStruct) emit(event *PresenceEvent) {
+	p.events = append(p.events, event)
+
+	select {
+	case p.eventChan <- struct{}{}:
+	default:
+	}
+}
+
+// emitter calls the listeners of the queued events, one event after the other.
+func (p *presenceStruct) emitter() {
+	for range p.eventChan {
+		p.mutex.Lock()
+		events := p.events
+		p.events = nil
+		p.mutex.Unlock()
+
+		for _, event := range events {
+			p.mutex.Lock()
+			listeners := p.listeners[event.Event]
+			p.mutex.Unlock()
+
+			for _, listener := range listeners {
+				listener(event)
+			}
+		}
+	}
+}
+
+// PresenceConnect registers a connection of the user. The first connection
+// of an offline user emits presence.join.
+func PresenceConnect(userId uint64, transport string, key string) {
+	if userId == 0 {
+		return
+	}
+
+	p := &presenceApp
+
+	p.mutex.Lock()
+	p.presence()
+
+	online := len(p.users[userId]) > 0
+
+	if _, ok := p.users[userId]; !ok {
+		p.users[userId] = map[string]map[string]bool{}
+	}
+
+	if _, ok := p.users[userId][transport]; !ok {
+		p.users[userId][transport] = map[string]bool{}
+	}
+
+	p.users[userId][transport][key] = true
+	p.dirty[userId] = true
+
+	if !online {
+		p.emit(&PresenceEvent{
+			Event:     PresenceJoin,
+			UserId:    userId,
+			Transport: transport,
+			Key:       key,
+			Time:      time.Now(),
+		})
+	}
+	p.mutex.Unlock()
+}
+
+// PresenceDisconnect removes a connection of the user. The last connection
+// of the user emits presence.leave.
+func PresenceDisconnect(userId uint64, transport string, key string) {
+	if userId == 0 {
+		return
+	}
+
+	p := &presenceApp
+
+	p.mutex.Lock()
+	p.presence()
+
+	if _, ok := p.users[userId][transport][key]; !ok {
+		p.mutex.Unlock()
+		return
+	}
+
+	delete(p.users[userId][transport], key)
+
+	if len(p.users[userId][transport]) == 0 {
+		delete(p.users[userId], transport)
+	}
+
+	offline := len(p.users[userId]) == 0
+
+	if offline {
+		delete(p.users, userId)
+	}
+
+	p.dirty[userId] = true
+
+	if offline {
+		p.emit(&PresenceEvent{
+			Event:     PresenceLeave,
+			UserId:    userId,
+			Transport: transport,
+			Key:       key,
+			Time:      time.Now(),
+		})
+	}
+	p.mutex.Unlock()
+}
+
+// PresenceOn subscribes the listener to presence.join or presence.leave.
+func PresenceOn(event string, listener func(*PresenceEvent)) {
+	p := &presenceApp
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.presence()
+	p.listeners[event] = append(p.listeners[event], listener)
+}
+
+func PresenceIsOnline(userId uint64) bool {
+	p := &presenceApp
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	_, ok := p.presence().users[userId]
+
+	return ok
+}
+
+// PresenceTransports returns the transports the user is connected with.
+func PresenceTransports(userId uint64) []string {
+	p := &presenceApp
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	transports := []string{}
+
+	for transport, _ := range p.presence().users[userId] {
+		transports = append(transports, transport)
+	}
+
+	sort.Strings(transports)
+
+	return transports
+}
+
+func PresenceUsers() []uint64 {
+	p := &presenceApp
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	users := make([]uint64, 0, len(p.presence().users))
+
+	for userId, _ := range p.users {
+		users = append(users, userId)
+	}
+
+	return users
+}
@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"sync/atomic"
+
+	"backnet/components"
+)
+
+const (
+	RateLimitDrop       = "drop"
+	RateLimitWarn       = "warn"
+	RateLimitDisconnect = "disconnect"
+
+	// Event of the warning frame sent to a limited client
+	RateLimitEvent = "rate.limit"
+)
+
+// RateLimit limits the incoming messages of the connections of one transport
+// per connection and per IP address.
+type RateLimit struct {
+	Policy string
+
+	Conn *components.RateLimiter
+	Ip   *components.RateLimiter
+
+	Dropped      uint64
+	Warned       uint64
+	Disconnected uint64
+}
+
+type RateLimitStats struct {
+	Dropped      uint64 `json:"dropped"`
+	Warned       uint64 `json:"warned"`
+	Disconnected uint64 `json:"disconnected"`
+}
+
+// NewRateLimit creates the limits. A zero rate is unlimited.
+func NewRateLimit(rate float64, burst int, ipRate float64, ipBurst int, policy string) *RateLimit {
+	return &RateLimit{
+		Policy: policy,
+		Conn:   components.NewRateLimiter(rate, burst),
+		Ip:     components.NewRateLimiter(ipRate, ipBurst),
+	}
+}
+
+// Check takes a token of the connection and of its IP address, none when one
+// of them is out of tokens. It returns "" when the message is allowed,
+// otherwise the policy to apply.
+func (rl *RateLimit) Check(key string, ip string) string {
+	if rl == nil {
+		return ""
+	}
+
+	if rl.Conn.Allow(key) {
+		if rl.Ip.Allow(ip) {
+			return ""
+		}
+
+		// The message is not sent, the connection keeps its token
+		rl.Conn.Refund(key)
+	}
+
+	switch rl.Policy {
+	case RateLimitWarn:
+		atomic.AddUint64(&rl.Warned, 1)
+
+		return RateLimitWarn
+	case RateLimitDisconnect:
+		atomic.AddUint64(&rl.Disconnected, 1)
+
+		return RateLimitDisconnect
+	default:
+		atomic.AddUint64(&rl.Dropped, 1)
+
+		return RateLimitDrop
+	}
+}
+
+// Forget drops the bucket of a closed connection.
+func (rl *RateLimit) Forget(key string) {
+	if rl != nil {
+		rl.Conn.Delete(key)
+	}
+}
+
+func (rl *RateLimit) Stats() RateLimitStats {
+	if rl == nil {
+		return RateLimitStats{}
+	}
+
+	return RateLimitStats{
+		Dropped:      atomic.LoadUint64(&rl.Dropped),
+		Warned:       atomic.LoadUint64(&rl.Warned),
+		Disconnected: atomic.LoadUint64(&rl.Disconnected),
+	}
+}
+
+func (stats RateLimitStats) Add(other RateLimitStats) RateLimitStats {
+	return RateLimitStats{
+		Dropped:      stats.Dropped + other.Dropped,
+		Warned:       stats.Warned + other.Warned,
+		Disconnected: stats.Disconnected + other.Disconnected,
+	}
+}
+
+// WebsocketRateLimitStats sums the counters of all the websocket routes.
+func WebsocketRateLimitStats() RateLimitStats {
+	stats := RateLimitStats{}
+
+	for _, ws := range WebsocketHubs() {
+		if ws.Config != nil {
+			stats = stats.Add(ws.Config.RateLimit.Stats())
+		}
+	}
+
+	return stats
+}
+
+func SseRateLimitStats() RateLimitStats {
+	sseApi, err := SseApi()
+	if err != nil {
+		return RateLimitStats{}
+	}
+
+	return sseApi.RateLimit.Stats()
+}
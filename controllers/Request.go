@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"errors"
+	"net"
 	"net/http"
 
 	"backnet/components"
@@ -99,6 +100,41 @@ func NewRequest(w http.ResponseWriter, r *http.Request) *Request {
 	return &req
 }
 
+// SessionUser resolves the authorized user of the request the same way
+// NewRequest does, but never writes to the response.
+func SessionUser(r *http.Request) *models.User {
+	user := models.NewUser()
+
+	db, err := components.DB()
+	if err != nil {
+		return user
+	}
+
+	s, _ := components.Session(r)
+
+	sess, err := components.NewSess(s)
+	if err != nil {
+		return user
+	}
+
+	switch value := sess.Get("AuthUserId").(type) {
+	case int, uint, int8, uint8, int16, uint16, int32, uint32, int64, uint64:
+		db.Find(user, "id = ?", value)
+	}
+
+	return user
+}
+
+// RequestIp returns the IP address of the remote end of the request.
+func RequestIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
 func (req *Request) IsAuth() bool {
 	if req.Valid {
 		if req.User != nil {
@@ -0,0 +1,15 @@
+package controllers
+
+type RoomWebsocket struct {
+	Client *WebsocketClient
+	Room   string
+	Join   bool
+}
+
+func NewRoomWebsocket(wsClient *WebsocketClient, room string, join bool) *RoomWebsocket {
+	return &RoomWebsocket{
+		Client: wsClient,
+		Room:   room,
+		Join:   join,
+	}
+}
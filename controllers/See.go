@@ -3,11 +3,15 @@ package controllers
 import (
 	"backnet/components"
 	"backnet/config"
+	"backnet/models"
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -22,27 +26,81 @@ type ApiSse struct {
 	EventI    uint64
 	ConnectI  uint64
 	OnConnect func(*SseConnection)
-	OnMessage func(string, string)
+	OnMessage func(string, string, *models.User)
 	OnClose   func(*SseConnection)
+	RateLimit *RateLimit
+	History   *SseHistory
 	Valid     bool
+
+	// The open connections of this node
+	connections map[string]*SseConnection
+	mutex       sync.Mutex
+
+	// The key of the client tokens
+	tokenSecret []byte
 }
 
 type SseConnection struct {
 	Connection *netsse.ClientConnection
+	UserId     uint64
+	Ip         string
+	ConnectAt  time.Time
+
+	// Unix time of the last message of the client
+	Time int64
+
+	// Cancels the stream, to disconnect it from the server side
+	cancel context.CancelFunc
+
+	// The channels the client is subscribed to
+	channels map[string]bool
+	mutex    sync.Mutex
+
+	// The live events wait while the connect event and the replay are sent,
+	// the ones up to replayedN are in the replay
+	replaying bool
+	replayedN uint64
+	pending   []*sseHistoryItem
 }
 
 var seeApp ApiSse
 
+// SseEvent is a StringEvent with the retry field, the reconnection delay of
+// the browser in milliseconds.
+type SseEvent struct {
+	netsse.StringEvent
+	Retry int64
+}
+
+func (e SseEvent) Prepare() []byte {
+	data := e.StringEvent.Prepare()
+
+	if e.Retry > 0 {
+		data = append([]byte(fmt.Sprintf("retry: %d\n", e.Retry)), data...)
+	}
+
+	return data
+}
+
 func NewSseConnection(conn *netsse.ClientConnection) *SseConnection {
 	return &SseConnection{
 		Connection: conn,
+		ConnectAt:  time.Now(),
+		Time:       time.Now().Unix(),
+		channels:   map[string]bool{},
 	}
 }
 
 func (api *ApiSse) UniqueEventId() string {
-	atomic.AddUint64(&api.EventI, 1)
+	id, _ := api.nextEventId()
 
-	return fmt.Sprintf("sse:%v:%v", api.Key, api.EventI)
+	return id
+}
+
+func (api *ApiSse) nextEventId() (string, uint64) {
+	n := atomic.AddUint64(&api.EventI, 1)
+
+	return fmt.Sprintf("sse:%v:%v", api.Key, n), n
 }
 
 func (api *ApiSse) UniqueConnectId() string {
@@ -52,45 +110,178 @@ func (api *ApiSse) UniqueConnectId() string {
 }
 
 func (api *ApiSse) SseHandler(writer http.ResponseWriter, request *http.Request) {
-	// set the heartbeat interval to 1 minute
-	client, err := api.Broker.ConnectWithHeartBeatInterval(api.UniqueConnectId(), writer, request, 1*time.Minute)
+	ctx, cancel := context.WithCancel(request.Context())
+	defer cancel()
+
+	sseConn, err := api.connect(writer, request.WithContext(ctx), cancel)
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
+	client := sseConn.Connection
+
+	PresenceConnect(sseConn.UserId, PresenceTransportSse, sseConn.Key())
+
+	if api.OnConnect != nil {
+		api.OnConnect(sseConn)
+	}
+
+	<-client.Done()
+
+	api.mutex.Lock()
+	delete(api.connections, client.Id())
+	api.mutex.Unlock()
+
+	api.RateLimit.Forget(client.Id())
+
+	PresenceDisconnect(sseConn.UserId, PresenceTransportSse, sseConn.Key())
+
+	if api.OnClose != nil {
+		api.OnClose(sseConn)
+	}
+}
+
+// connect opens the stream, subscribes the client to ?channels=a,b and sends
+// the connect event. A client reconnecting with Last-Event-ID (or
+// ?last_event_id=) gets the events it missed. Its own ones only come with
+// ?token= of its old connect event, for the client of the id or ?client_id=.
+func (api *ApiSse) connect(writer http.ResponseWriter, request *http.Request, cancel context.CancelFunc) (*SseConnection, error) {
+	lastEventId := request.Header.Get("Last-Event-ID")
+
+	if lastEventId == "" {
+		lastEventId = request.URL.Query().Get("last_event_id")
+	}
+
+	// set the heartbeat interval to 1 minute
+	client, err := api.Broker.ConnectWithHeartBeatInterval(api.UniqueConnectId(), writer, request, 1*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	sseConn := NewSseConnection(client)
+	sseConn.Ip = RequestIp(request)
+	sseConn.cancel = cancel
+	sseConn.replaying = true
+	sseConn.Subscribe(SseParseChannels(request.URL.Query().Get("channels"))...)
+
+	if user := SessionUser(request); user.Valid() {
+		sseConn.UserId = uint64(user.Id.Get())
+	}
+
+	api.mutex.Lock()
+	api.connections[client.Id()] = sseConn
+	api.mutex.Unlock()
+
 	data := ""
 
 	json := simplejson.New()
 	json.Set("client_id", client.Id())
+	json.Set("token", api.Token(request, client.Id(), sseConn.UserId))
+	json.Set("channels", sseConn.Channels())
 
 	payload, err := json.MarshalJSON()
 	if err == nil {
 		components.СonvertAssign(&data, payload)
 	}
 
+	// The client is registered before the history is read: the events stored
+	// until now are replayed, the next ones wait for the end of the replay.
+	var events []netsse.Event
+	replayed := true
+
+	if api.History != nil && lastEventId != "" {
+		var n uint64
+
+		events, n, replayed = api.replay(request, sseConn, lastEventId)
+
+		if replayed {
+			sseConn.mutex.Lock()
+			sseConn.replayedN = n
+			sseConn.mutex.Unlock()
+		}
+	}
+
 	api.Broker.Send(client.Id(), netsse.StringEvent{
 		Id:    api.UniqueEventId(),
 		Event: "connect",
 		Data:  data,
 	})
 
-	if api.OnConnect != nil {
-		api.OnConnect(NewSseConnection(client))
+	if replayed {
+		for _, event := range events {
+			api.Broker.Send(client.Id(), event)
+		}
+	} else {
+		api.reset(sseConn, lastEventId)
 	}
 
-	<-client.Done()
+	sseConn.replayDone(api)
 
-	if api.OnClose != nil {
-		api.OnClose(NewSseConnection(client))
+	return sseConn, nil
+}
+
+// replay returns the events after lastEventId and the number of the last event
+// stored, false when the history does not have all of them. The events of the
+// old client are left out unless the token of the request was issued for it.
+func (api *ApiSse) replay(request *http.Request, sseConn *SseConnection, lastEventId string) ([]netsse.Event, uint64, bool) {
+	if sseKey, n, ok := SseParseEventId(lastEventId); ok && sseKey == api.Key {
+		oldKey := request.URL.Query().Get("client_id")
+		channels := sseConn.Channels()
+
+		api.History.mutex.Lock()
+		defer api.History.mutex.Unlock()
+
+		if oldKey == "" {
+			oldKey = api.History.client(n)
+		}
+
+		if _, ok := api.VerifyToken(request, oldKey, request.URL.Query().Get("token")); !ok {
+			oldKey = ""
+		}
+
+		events, ok := api.History.since(oldKey, channels, n)
+
+		// The events are numbered and stored under the mutex
+		return events, atomic.LoadUint64(&api.EventI), ok
 	}
+
+	return nil, 0, false
+}
+
+// reset tells the client that the events after lastEventId are lost.
+func (api *ApiSse) reset(sseConn *SseConnection, lastEventId string) {
+	key := sseConn.Key()
+
+	data := ""
+
+	json := simplejson.New()
+	json.Set("last_event_id", lastEventId)
+
+	payload, err := json.MarshalJSON()
+	if err == nil {
+		components.СonvertAssign(&data, payload)
+	}
+
+	api.Broker.Send(key, netsse.StringEvent{
+		Id:    api.UniqueEventId(),
+		Event: SseResetEvent,
+		Data:  data,
+	})
 }
 
 func (api *ApiSse) api() *ApiSse {
 	if !api.Valid {
-		api.Broker = netsse.NewBroker(map[string]string{
-			"Access-Control-Allow-Origin": "*",
-		})
+		// The CORS headers are set by the Cors handler of the router
+		api.Broker = netsse.NewBroker(map[string]string{})
+
+		api.RateLimit = NewRateLimit(config.SseRate, config.SseRateBurst, config.SseRateIp, config.SseRateIpBurst, config.SseRatePolicy)
+		api.connections = map[string]*SseConnection{}
+		api.tokenSecret = sseTokenSecret()
+
+		if config.SseHistorySize > 0 {
+			api.History = NewSseHistory(config.SseHistorySize, config.SseHistoryMaxAge)
+		}
 
 		api.Valid = true
 		api.Key = uint64(time.Now().Unix())
@@ -123,7 +314,7 @@ func SseOnMessage(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 
 	if err == nil {
-		if r.Form.Get("client_id") != "" && r.Form.Get("data") != "" {
+		if r.Form.Get("client_id") != "" && r.Form.Get("token") != "" && (r.Form.Get("data") != "" || r.Form.Get("subscribe") != "" || r.Form.Get("unsubscribe") != "") {
 			splitKey := strings.Split(r.Form.Get("client_id"), ":")
 
 			if len(splitKey) == 4 {
@@ -131,8 +322,45 @@ func SseOnMessage(w http.ResponseWriter, r *http.Request) {
 					if sseKey, err := strconv.ParseUint(splitKey[1], 10, 64); err == nil {
 						if sseKey == sseApi.Key {
 							if sseApi.Broker.IsClientPresent(splitKey[0] + ":" + splitKey[1] + ":" + splitKey[2] + ":" + splitKey[3]) {
-								if sseApi.OnMessage != nil {
-									sseApi.OnMessage(splitKey[0]+":"+splitKey[1]+":"+splitKey[2]+":"+splitKey[3], r.Form.Get("data"))
+								// The token is issued with the connect event for the session of the client
+								userId, ok := sseApi.VerifyToken(r, splitKey[0]+":"+splitKey[1]+":"+splitKey[2]+":"+splitKey[3], r.Form.Get("token"))
+								if !ok {
+									http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+									return
+								}
+
+								user := SessionUser(r)
+
+								if uint64(user.Id.Get()) != userId {
+									http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+									return
+								}
+
+								if !sseApi.limit(splitKey[0]+":"+splitKey[1]+":"+splitKey[2]+":"+splitKey[3], RequestIp(r)) {
+									http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+									return
+								}
+
+								if sseConn := sseApi.Connection(splitKey[0] + ":" + splitKey[1] + ":" + splitKey[2] + ":" + splitKey[3]); sseConn != nil {
+									atomic.StoreInt64(&sseConn.Time, time.Now().Unix())
+
+									// subscribe=a,b and unsubscribe=c change the channels of the client
+									if r.Form.Get("subscribe") != "" || r.Form.Get("unsubscribe") != "" {
+										sseConn.Subscribe(SseParseChannels(r.Form.Get("subscribe"))...)
+										sseConn.Unsubscribe(SseParseChannels(r.Form.Get("unsubscribe"))...)
+
+										json := simplejson.New()
+										json.Set("channels", sseConn.Channels())
+
+										if payload, err := json.MarshalJSON(); err == nil {
+											w.Header().Set("Content-Type", "application/json")
+											w.Write(payload)
+										}
+									}
+								}
+
+								if sseApi.OnMessage != nil && r.Form.Get("data") != "" {
+									sseApi.OnMessage(splitKey[0]+":"+splitKey[1]+":"+splitKey[2]+":"+splitKey[3], r.Form.Get("data"), user)
 								}
 							}
 						}
@@ -143,64 +371,365 @@ func SseOnMessage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (api *ApiSse) Send(key string, data string) {
+// limit applies the rate limit to a message of the connection. It returns
+// false when the message has to be rejected.
+func (api *ApiSse) limit(key string, ip string) bool {
+	switch api.RateLimit.Check(key, ip) {
+	case "":
+		return true
+	case RateLimitWarn:
+		api.Broker.Send(key, netsse.StringEvent{
+			Id:    api.UniqueEventId(),
+			Event: RateLimitEvent,
+			Data:  "{}",
+		})
+	case RateLimitDisconnect:
+		api.Disconnect(key)
+	}
+
+	return false
+}
+
+// Connection returns the open connection of this node with the key.
+func (api *ApiSse) Connection(key string) *SseConnection {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+
+	return api.connections[key]
+}
+
+// Disconnect closes the stream of the connection.
+func (api *ApiSse) Disconnect(key string) {
+	api.mutex.Lock()
+	sseConn, ok := api.connections[key]
+	api.mutex.Unlock()
+
+	if ok {
+		sseConn.cancel()
+	}
+}
+
+func (api *ApiSse) Send(key string, data string) bool {
+	return api.SendEvent(key, &SseMessage{Data: data})
+}
+
+func (api *ApiSse) SendAll(data string) {
+	api.SendAllEvent(&SseMessage{Data: data})
+}
+
+// SendEvent sends the message to the client of this node with the key.
+func (api *ApiSse) SendEvent(key string, message *SseMessage) bool {
 	splitKey := strings.Split(key, ":")
 
 	if len(splitKey) == 4 {
 		if splitKey[0] == "sse" {
 			if sseKey, err := strconv.ParseUint(splitKey[1], 10, 64); err == nil {
 				if sseKey == api.Key {
-					api.Broker.Send(splitKey[0]+":"+splitKey[1]+":"+splitKey[2]+":"+splitKey[3], netsse.StringEvent{
-						Id:    SseUniqueEventId(),
-						Event: "message",
-						Data:  data,
-					})
+					return api.send(splitKey[0]+":"+splitKey[1]+":"+splitKey[2]+":"+splitKey[3], message)
 				}
 			}
 		}
 	}
+
+	return false
 }
 
-func (api *ApiSse) SendAll(data string) {
-	api.Broker.Broadcast(netsse.StringEvent{
-		Id:    SseUniqueEventId(),
-		Event: "message",
-		Data:  data,
-	})
+func (api *ApiSse) SendAllEvent(message *SseMessage) {
+	api.send("", message)
+}
+
+// send keeps the message in the history and sends it to the client, to all
+// clients for "". The history is not locked while sending, a slow client
+// must not stop the others.
+func (api *ApiSse) send(key string, message *SseMessage) bool {
+	if api.History != nil {
+		api.History.mutex.Lock()
+	}
+
+	id, n := api.nextEventId()
+
+	sseEvent, err := message.event(id)
+
+	if api.History != nil {
+		if err == nil {
+			api.History.store(key, n, sseEvent)
+		}
+
+		api.History.mutex.Unlock()
+	}
+
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	if key == "" {
+		api.mutex.Lock()
+		connections := make([]*SseConnection, 0, len(api.connections))
+
+		for _, sseConn := range api.connections {
+			connections = append(connections, sseConn)
+		}
+		api.mutex.Unlock()
+
+		for _, sseConn := range connections {
+			sseConn.deliver(api, n, sseEvent)
+		}
+	} else if sseConn := api.Connection(key); sseConn != nil {
+		sseConn.deliver(api, n, sseEvent)
+	} else {
+		return false
+	}
+
+	return true
+}
+
+// deliver sends the live event number n to the client. It is dropped when it
+// was replayed and waits while the replay is sent.
+func (sConn *SseConnection) deliver(api *ApiSse, n uint64, event netsse.Event) {
+	sConn.mutex.Lock()
+
+	if n <= sConn.replayedN {
+		sConn.mutex.Unlock()
+		return
+	}
+
+	if sConn.replaying {
+		sConn.pending = append(sConn.pending, &sseHistoryItem{N: n, Event: event})
+		sConn.mutex.Unlock()
+		return
+	}
+	sConn.mutex.Unlock()
+
+	api.Broker.Send(sConn.Key(), event)
+}
+
+// replayDone sends the live events that came during the replay, in order, and
+// lets the next ones go at once.
+func (sConn *SseConnection) replayDone(api *ApiSse) {
+	for {
+		sConn.mutex.Lock()
+		pending := sConn.pending
+		sConn.pending = nil
+
+		if len(pending) == 0 {
+			sConn.replaying = false
+			sConn.mutex.Unlock()
+			return
+		}
+		sConn.mutex.Unlock()
+
+		sort.Slice(pending, func(i, j int) bool {
+			return pending[i].N < pending[j].N
+		})
+
+		for _, item := range pending {
+			if item.N > sConn.replayedN {
+				api.Broker.Send(sConn.Key(), item.Event)
+			}
+		}
+	}
 }
 
 func (sConn *SseConnection) Key() string {
 	return sConn.Connection.Id()
 }
 
+func (sConn *SseConnection) SendTo(key string, data string) {
+	SseSend(key, data)
+}
+
+// Send sends the data to the client with the key.
+//
+// Deprecated: use SendTo, or SendMessage for this client.
 func (sConn *SseConnection) Send(key string, data string) {
+	SseSend(key, data)
+}
+
+// SendMessage sends the message to this client as a "message" event.
+func (sConn *SseConnection) SendMessage(message any) bool {
 	sseApi, err := SseApi()
+	if err != nil {
+		return false
+	}
 
-	if err == nil {
-		sseApi.Send(key, data)
+	return sseApi.SendEvent(sConn.Key(), &SseMessage{Data: message})
+}
+
+func (sConn *SseConnection) SendAll(message any) {
+	SseSendAllEvent(&SseMessage{Data: message})
+}
+
+func (sConn *SseConnection) Transport() string {
+	return PresenceTransportSse
+}
+
+func (sConn *SseConnection) User() uint64 {
+	return sConn.UserId
+}
+
+func (sConn *SseConnection) Close() {
+	sConn.cancel()
+}
+
+// Handle serves the streams with the handler of all transports, the messages
+// are the data posted to /sse/message.
+func (api *ApiSse) Handle(handler ConnectionHandler) {
+	api.OnConnect = func(sseConn *SseConnection) {
+		handler.OnConnect(sseConn)
+	}
+
+	api.OnMessage = func(key string, data string, user *models.User) {
+		if sseConn := api.Connection(key); sseConn != nil {
+			handler.OnMessage(sseConn, []byte(data))
+		}
+	}
+
+	api.OnClose = func(sseConn *SseConnection) {
+		handler.OnClose(sseConn)
 	}
 }
 
-func (sConn *SseConnection) SendAll(data string) {
+func SseSend(key string, data string) {
+	SseSendEvent(key, &SseMessage{Data: data})
+}
+
+func SseSendAll(data string) {
+	SseSendAllEvent(&SseMessage{Data: data})
+}
+
+// SseSendEvent sends the message to the client with the key, on any node.
+func SseSendEvent(key string, message *SseMessage) {
 	sseApi, err := SseApi()
 
-	if err == nil {
-		sseApi.SendAll(data)
+	// A client of another node is reached through the backplane
+	if err != nil || !sseApi.SendEvent(key, message) {
+		if bpMessage, err := message.backplaneMessage(BackplaneActionKey, key); err == nil {
+			BackplanePublish(bpMessage)
+		}
 	}
 }
 
-func SseSend(key string, data string) {
+// SseSendAllEvent sends the message to all clients of every node.
+func SseSendAllEvent(message *SseMessage) {
 	sseApi, err := SseApi()
 
 	if err == nil {
-		sseApi.Send(key, data)
+		sseApi.SendAllEvent(message)
+	}
+
+	if bpMessage, err := message.backplaneMessage(BackplaneActionAll, ""); err == nil {
+		BackplanePublish(bpMessage)
 	}
 }
 
-func SseSendAll(data string) {
+// SseBackplaneReceive delivers a message published by another node.
+func SseBackplaneReceive(bpMessage *BackplaneMessage) {
+	sseApi, err := SseApi()
+
+	if err != nil {
+		return
+	}
+
+	message := sseBackplaneMessage(bpMessage)
+
+	switch bpMessage.Action {
+	case BackplaneActionAll:
+		sseApi.SendAllEvent(message)
+	case BackplaneActionKey:
+		sseApi.SendEvent(bpMessage.Key, message)
+	case BackplaneActionChannel:
+		sseApi.PublishEvent(bpMessage.Key, message)
+	}
+}
+
+// SseDrain asks every client to reconnect and closes the streams.
+func SseDrain(ctx context.Context) {
 	sseApi, err := SseApi()
 
+	if err != nil {
+		return
+	}
+
+	retry := int64(config.DrainRetry / time.Millisecond)
+
+	data := ""
+
+	json := simplejson.New()
+	json.Set("retry", retry)
+
+	payload, err := json.MarshalJSON()
 	if err == nil {
-		sseApi.SendAll(data)
+		components.СonvertAssign(&data, payload)
+	}
+
+	sseApi.Broker.Broadcast(SseEvent{
+		StringEvent: netsse.StringEvent{
+			Id:    sseApi.UniqueEventId(),
+			Event: DrainReconnect,
+			Data:  data,
+		},
+		Retry: retry,
+	})
+
+	sseApi.mutex.Lock()
+	for _, sseConn := range sseApi.connections {
+		sseConn.cancel()
+	}
+	sseApi.mutex.Unlock()
+
+	drainWait(ctx, func() uint64 {
+		sseApi.mutex.Lock()
+		defer sseApi.mutex.Unlock()
+
+		return uint64(len(sseApi.connections))
+	})
+}
+
+// SseConnections lists and controls the connections for the admin.
+func SseConnections() *ConnectionsProvider {
+	return &ConnectionsProvider{
+		List: func() []*ConnectionInfo {
+			connections := []*ConnectionInfo{}
+
+			sseApi, err := SseApi()
+			if err != nil {
+				return connections
+			}
+
+			sseApi.mutex.Lock()
+			defer sseApi.mutex.Unlock()
+
+			for _, sseConn := range sseApi.connections {
+				connections = append(connections, &ConnectionInfo{
+					Transport: PresenceTransportSse,
+					Key:       sseConn.Key(),
+					Ip:        sseConn.Ip,
+					UserId:    sseConn.UserId,
+					ConnectAt: sseConn.ConnectAt,
+					ActiveAt:  time.Unix(atomic.LoadInt64(&sseConn.Time), 0),
+				})
+			}
+
+			return connections
+		},
+		Disconnect: func(key string) bool {
+			sseApi, err := SseApi()
+			if err != nil || sseApi.Connection(key) == nil {
+				return false
+			}
+
+			sseApi.Disconnect(key)
+
+			return true
+		},
+		Send: func(key string, message string) bool {
+			sseApi, err := SseApi()
+			if err != nil {
+				return false
+			}
+
+			return sseApi.Send(key, message)
+		},
 	}
 }
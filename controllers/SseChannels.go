@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+// SseParseChannels splits the channel list "a,b,c".
+func SseParseChannels(list string) []string {
+	channels := []string{}
+
+	for _, channel := range strings.Split(list, ",") {
+		if channel = strings.TrimSpace(channel); channel != "" {
+			channels = append(channels, channel)
+		}
+	}
+
+	return channels
+}
+
+func (sConn *SseConnection) Subscribe(channels ...string) {
+	sConn.mutex.Lock()
+	defer sConn.mutex.Unlock()
+
+	for _, channel := range channels {
+		sConn.channels[channel] = true
+	}
+}
+
+func (sConn *SseConnection) Unsubscribe(channels ...string) {
+	sConn.mutex.Lock()
+	defer sConn.mutex.Unlock()
+
+	for _, channel := range channels {
+		delete(sConn.channels, channel)
+	}
+}
+
+func (sConn *SseConnection) Subscribed(channel string) bool {
+	sConn.mutex.Lock()
+	defer sConn.mutex.Unlock()
+
+	return sConn.channels[channel]
+}
+
+// Channels returns the channels of the client sorted by name.
+func (sConn *SseConnection) Channels() []string {
+	sConn.mutex.Lock()
+	channels := make([]string, 0, len(sConn.channels))
+
+	for channel := range sConn.channels {
+		channels = append(channels, channel)
+	}
+	sConn.mutex.Unlock()
+
+	sort.Strings(channels)
+
+	return channels
+}
+
+// SsePublish sends the event to the clients of this node subscribed to the
+// channel, "message" for an empty event name.
+func (api *ApiSse) SsePublish(channel string, event string, data string) {
+	api.PublishEvent(channel, &SseMessage{Event: event, Data: data})
+}
+
+// PublishEvent sends the message to the clients of this node subscribed to the channel.
+func (api *ApiSse) PublishEvent(channel string, message *SseMessage) {
+	if api.History != nil {
+		api.History.mutex.Lock()
+	}
+
+	id, n := api.nextEventId()
+
+	sseEvent, err := message.event(id)
+
+	if api.History != nil {
+		if err == nil {
+			api.History.storeChannel(channel, n, sseEvent)
+		}
+
+		api.History.mutex.Unlock()
+	}
+
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	api.mutex.Lock()
+	subscribers := []*SseConnection{}
+
+	for _, sseConn := range api.connections {
+		if sseConn.Subscribed(channel) {
+			subscribers = append(subscribers, sseConn)
+		}
+	}
+	api.mutex.Unlock()
+
+	for _, sseConn := range subscribers {
+		sseConn.deliver(api, n, sseEvent)
+	}
+}
+
+// SsePublish sends the event to the subscribers of the channel on every node.
+func SsePublish(channel string, event string, data string) {
+	SsePublishEvent(channel, &SseMessage{Event: event, Data: data})
+}
+
+func SsePublishEvent(channel string, message *SseMessage) {
+	sseApi, err := SseApi()
+
+	if err == nil {
+		sseApi.PublishEvent(channel, message)
+	}
+
+	if bpMessage, err := message.backplaneMessage(BackplaneActionChannel, channel); err == nil {
+		BackplanePublish(bpMessage)
+	}
+}
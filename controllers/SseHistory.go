@@ -0,0 +1,225 @@
+package controllers
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	netsse "github.com/subchord/go-sse"
+)
+
+// Event sent instead of the replay when the history no longer has the
+// events after the Last-Event-ID, the client has to reload its state.
+const SseResetEvent = "reset"
+
+type sseHistoryItem struct {
+	N     uint64
+	Event netsse.Event
+	Time  time.Time
+}
+
+type sseHistoryBuffer struct {
+	items []*sseHistoryItem
+
+	// The number of the last event removed from the buffer
+	dropped uint64
+}
+
+// SseHistory keeps the last events sent to all clients, to every client and
+// to every channel, so that an EventSource reconnecting with Last-Event-ID gets
+// what it missed.
+type SseHistory struct {
+	Size   int
+	MaxAge time.Duration
+
+	broadcasts *sseHistoryBuffer
+	clients    map[string]*sseHistoryBuffer
+	channels   map[string]*sseHistoryBuffer
+
+	// The client of every event in the client buffers
+	index map[uint64]string
+
+	// The number of the last event of the removed clients and channels
+	dropped uint64
+
+	expireAt time.Time
+	mutex    sync.Mutex
+}
+
+func NewSseHistory(size int, maxAge time.Duration) *SseHistory {
+	if size < 1 {
+		size = 1
+	}
+
+	return &SseHistory{
+		Size:       size,
+		MaxAge:     maxAge,
+		broadcasts: &sseHistoryBuffer{},
+		clients:    map[string]*sseHistoryBuffer{},
+		channels:   map[string]*sseHistoryBuffer{},
+		index:      map[uint64]string{},
+	}
+}
+
+// store puts the event number n into the buffer of the client, "" for all.
+// The caller holds the mutex.
+func (history *SseHistory) store(key string, n uint64, event netsse.Event) {
+	buffer := history.broadcasts
+
+	if key != "" {
+		if buffer = history.clients[key]; buffer == nil {
+			buffer = &sseHistoryBuffer{}
+			history.clients[key] = buffer
+		}
+
+		history.index[n] = key
+	}
+
+	history.push(buffer, n, event)
+}
+
+// storeChannel puts the event number n into the buffer of the channel.
+func (history *SseHistory) storeChannel(channel string, n uint64, event netsse.Event) {
+	buffer := history.channels[channel]
+
+	if buffer == nil {
+		buffer = &sseHistoryBuffer{}
+		history.channels[channel] = buffer
+	}
+
+	history.push(buffer, n, event)
+}
+
+func (history *SseHistory) push(buffer *sseHistoryBuffer, n uint64, event netsse.Event) {
+	buffer.items = append(buffer.items, &sseHistoryItem{
+		N:     n,
+		Event: event,
+		Time:  time.Now(),
+	})
+
+	if len(buffer.items) > history.Size {
+		history.drop(buffer, len(buffer.items)-history.Size)
+	}
+
+	history.expire()
+}
+
+func (history *SseHistory) drop(buffer *sseHistoryBuffer, count int) {
+	for _, item := range buffer.items[:count] {
+		delete(history.index, item.N)
+		buffer.dropped = item.N
+	}
+
+	buffer.items = buffer.items[count:]
+}
+
+// expire forgets the events older than MaxAge and the clients and channels without events.
+func (history *SseHistory) expire() {
+	// Once a second is enough, every store would have to walk all the clients
+	if history.MaxAge <= 0 || time.Now().Before(history.expireAt) {
+		return
+	}
+
+	history.expireAt = time.Now().Add(time.Second)
+
+	expired := time.Now().Add(-history.MaxAge)
+
+	history.expireBuffer(history.broadcasts, expired)
+
+	for _, buffers := range []map[string]*sseHistoryBuffer{history.clients, history.channels} {
+		for key, buffer := range buffers {
+			if history.expireBuffer(buffer, expired); len(buffer.items) == 0 {
+				if buffer.dropped > history.dropped {
+					history.dropped = buffer.dropped
+				}
+
+				delete(buffers, key)
+			}
+		}
+	}
+}
+
+func (history *SseHistory) expireBuffer(buffer *sseHistoryBuffer, expired time.Time) {
+	i := 0
+
+	for i < len(buffer.items) && buffer.items[i].Time.Before(expired) {
+		i++
+	}
+
+	if i > 0 {
+		history.drop(buffer, i)
+	}
+}
+
+// since returns the events of all clients, of the client and of the channels
+// after n. It is false when some of them were already removed. The caller
+// holds the mutex.
+func (history *SseHistory) since(key string, channels []string, n uint64) ([]netsse.Event, bool) {
+	history.expire()
+
+	if n < history.dropped {
+		return nil, false
+	}
+
+	buffers := []*sseHistoryBuffer{history.broadcasts}
+
+	if buffer, ok := history.clients[key]; ok && key != "" {
+		buffers = append(buffers, buffer)
+	}
+
+	for _, channel := range channels {
+		if buffer, ok := history.channels[channel]; ok {
+			buffers = append(buffers, buffer)
+		}
+	}
+
+	items := []*sseHistoryItem{}
+
+	for _, buffer := range buffers {
+		if n < buffer.dropped {
+			return nil, false
+		}
+
+		for _, item := range buffer.items {
+			if item.N > n {
+				items = append(items, item)
+			}
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].N < items[j].N
+	})
+
+	events := make([]netsse.Event, 0, len(items))
+
+	for _, item := range items {
+		events = append(events, item.Event)
+	}
+
+	return events, true
+}
+
+// client returns the client that got the event number n.
+func (history *SseHistory) client(n uint64) string {
+	return history.index[n]
+}
+
+// SseParseEventId splits an event id sse:<key>:<n> into the numbers.
+func SseParseEventId(id string) (sseKey uint64, n uint64, ok bool) {
+	splitId := strings.Split(id, ":")
+
+	if len(splitId) == 3 {
+		if splitId[0] == "sse" {
+			if sseKey, err := strconv.ParseUint(splitId[1], 10, 64); err == nil {
+				if n, err := strconv.ParseUint(splitId[2], 10, 64); err == nil {
+					return sseKey, n, true
+				}
+			}
+		}
+	}
+
+	return 0, 0, false
+}
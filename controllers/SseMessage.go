@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	netsse "github.com/subchord/go-sse"
+)
+
+// SseMessage is an event for the EventSource of the clients. A string or
+// []byte Data is sent as is, any other value as JSON, a multi-line data is
+// split into data: lines. Retry sets the reconnection delay of the browser.
+type SseMessage struct {
+	Event string
+	Data  any
+	Retry time.Duration
+}
+
+var sseLineReplacer = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+func (message *SseMessage) data() (string, error) {
+	switch data := message.Data.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return sseLineReplacer.Replace(data), nil
+	case []byte:
+		return sseLineReplacer.Replace(string(data)), nil
+	}
+
+	payload, err := json.Marshal(message.Data)
+	if err != nil {
+		return "", err
+	}
+
+	return string(payload), nil
+}
+
+// event builds the event with the id, "message" for an empty event name.
+func (message *SseMessage) event(id string) (SseEvent, error) {
+	data, err := message.data()
+	if err != nil {
+		return SseEvent{}, err
+	}
+
+	event := message.Event
+
+	if event == "" {
+		event = "message"
+	}
+
+	return SseEvent{
+		StringEvent: netsse.StringEvent{
+			Id:    id,
+			Event: event,
+			Data:  data,
+		},
+		Retry: int64(message.Retry / time.Millisecond),
+	}, nil
+}
+
+// backplaneMessage relays the message with the data already encoded.
+func (message *SseMessage) backplaneMessage(action string, key string) (*BackplaneMessage, error) {
+	data, err := message.data()
+	if err != nil {
+		return nil, err
+	}
+
+	bpMessage := NewBackplaneMessage("sse", action, key, 0, data)
+	bpMessage.Event = message.Event
+	bpMessage.Retry = int64(message.Retry / time.Millisecond)
+
+	return bpMessage, nil
+}
+
+func sseBackplaneMessage(bpMessage *BackplaneMessage) *SseMessage {
+	return &SseMessage{
+		Event: bpMessage.Event,
+		Data:  bpMessage.Data,
+		Retry: time.Duration(bpMessage.Retry) * time.Millisecond,
+	}
+}
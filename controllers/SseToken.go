@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"backnet/components"
+	"backnet/config"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sseTokenSecret is SSE_TOKEN_SECRET, SESSION_KEY or a random key of the node.
+func sseTokenSecret() []byte {
+	if secret := config.Env("SSE_TOKEN_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+
+	if secret := config.Env("SESSION_KEY"); secret != "" {
+		return []byte(secret)
+	}
+
+	return []byte(components.RandString(32))
+}
+
+func sseSessionId(r *http.Request) string {
+	if s, err := components.Session(r); err == nil && s != nil {
+		return s.ID
+	}
+
+	return ""
+}
+
+func (api *ApiSse) tokenSign(key string, userId uint64, sessionId string, expires int64) string {
+	mac := hmac.New(sha256.New, api.tokenSecret)
+	fmt.Fprintf(mac, "%s|%d|%s|%d", key, userId, sessionId, expires)
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Token issues the token of the client for /sse/message: <user id>.<expires>.<signature>.
+// It is bound to the session of the request and expires after SseTokenTtl.
+func (api *ApiSse) Token(r *http.Request, key string, userId uint64) string {
+	expires := time.Now().Add(config.SseTokenTtl).Unix()
+
+	return fmt.Sprintf("%d.%d.%s", userId, expires, api.tokenSign(key, userId, sseSessionId(r), expires))
+}
+
+// VerifyToken checks the token of the client against the session of the
+// request and returns the user id it was issued for.
+func (api *ApiSse) VerifyToken(r *http.Request, key string, token string) (uint64, bool) {
+	splitToken := strings.Split(token, ".")
+
+	if len(splitToken) == 3 {
+		if userId, err := strconv.ParseUint(splitToken[0], 10, 64); err == nil {
+			if expires, err := strconv.ParseInt(splitToken[1], 10, 64); err == nil && time.Now().Unix() < expires {
+				if hmac.Equal([]byte(splitToken[2]), []byte(api.tokenSign(key, userId, sseSessionId(r), expires))) {
+					return userId, true
+				}
+			}
+		}
+	}
+
+	return 0, false
+}
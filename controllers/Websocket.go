@@ -1,9 +1,10 @@
 package controllers
 
 import (
-	"backnet/config"
+	"bytes"
+	"context"
+	"encoding/json"
 	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,6 +14,7 @@ import (
 
 type ClientsStack struct {
 	Clients map[uint64]*WebsocketClient
+	Rooms   map[string]map[uint64]*WebsocketClient
 }
 
 type WebsocketStack struct {
@@ -21,6 +23,10 @@ type WebsocketStack struct {
 	Register   chan *WebsocketClient
 	Broadcast  chan *BroadcastWebsocket
 	Unregister chan *WebsocketClient
+	Room       chan *RoomWebsocket
+	Drain      chan string
+	List       chan chan []*WebsocketClient
+	Done       chan struct{}
 	Count      uint64
 	I          uint64
 	Key        uint64
@@ -28,19 +34,31 @@ type WebsocketStack struct {
 
 type Websocket struct {
 	Mutex           sync.Mutex
+	StackMutex      sync.RWMutex
 	Stack           map[uint64]*WebsocketStack
+	MinStacks       int
+	MaxStacks       int
+	Name            string
 	Key             uint64
 	MaxCountInStack uint64
 	I               uint64
+	Auth            bool
+	Config          *WebsocketConfig
+	Upgrader        *websocket.Upgrader
+	Replay          *WebsocketReplay
+	Users           map[uint64]map[string]*WebsocketClient
 	FuncRegister    func(*WebsocketClient)
-	FuncMessage     func(*WebsocketClient, []byte)
+	FuncMessage     func(*WebsocketClient, int, []byte)
 	FuncUnregister  func(*WebsocketClient)
+	FuncFilter      func(int, []byte) []byte
 }
 
-var Websockets map[uint64]*Websocket
-
 func (stack *ClientsStack) DeleteClient(ClientKey uint64) bool {
-	if _, ok := stack.Clients[ClientKey]; ok {
+	if wsClient, ok := stack.Clients[ClientKey]; ok {
+		for _, room := range wsClient.RoomList() {
+			stack.LeaveRoom(wsClient, room)
+		}
+
 		delete(stack.Clients, ClientKey)
 
 		return true
@@ -49,11 +67,37 @@ func (stack *ClientsStack) DeleteClient(ClientKey uint64) bool {
 	return false
 }
 
+func (stack *ClientsStack) JoinRoom(wsClient *WebsocketClient, room string) {
+	if _, ok := stack.Clients[wsClient.ClientKey]; !ok {
+		return
+	}
+
+	if _, ok := stack.Rooms[room]; !ok {
+		stack.Rooms[room] = make(map[uint64]*WebsocketClient)
+	}
+
+	stack.Rooms[room][wsClient.ClientKey] = wsClient
+	wsClient.setRoom(room, true)
+}
+
+func (stack *ClientsStack) LeaveRoom(wsClient *WebsocketClient, room string) {
+	if clients, ok := stack.Rooms[room]; ok {
+		delete(clients, wsClient.ClientKey)
+
+		if len(clients) == 0 {
+			delete(stack.Rooms, room)
+		}
+	}
+
+	wsClient.setRoom(room, false)
+}
+
 func (ws *Websocket) DeleteStack(key uint64) {
-	ws.Mutex.Lock()
-	defer ws.Mutex.Unlock()
-	if _, ok := ws.Stack[key]; ok {
+	ws.StackMutex.Lock()
+	defer ws.StackMutex.Unlock()
+	if wsStack, ok := ws.Stack[key]; ok {
 		delete(ws.Stack, key)
+		close(wsStack.Done)
 	}
 }
 
@@ -73,98 +117,105 @@ func (wsStack *WebsocketStack) CountDecrement() {
 	}
 }
 
+func (wsStack *WebsocketStack) CountGet() uint64 {
+	wsStack.Mutex.Lock()
+	defer wsStack.Mutex.Unlock()
+
+	return wsStack.Count
+}
+
 func (wsStack *WebsocketStack) Delete() {
 	if wsStack.Ws != nil {
 		wsStack.Ws.DeleteStack(wsStack.Key)
 	}
 }
 
-func NewWebsocket(maxConnect uint64, register func(*WebsocketClient), message func(*WebsocketClient, []byte), unregister func(*WebsocketClient)) *Websocket {
-	if Websockets == nil {
-		Websockets = make(map[uint64]*Websocket)
-	}
-
-	key := uint64(time.Now().Unix())
-
-	Websockets[key] = &Websocket{
+// NewWebsocket creates the hub and registers it by name.
+func NewWebsocket(name string, maxConnect uint64, register func(*WebsocketClient), message func(*WebsocketClient, int, []byte), unregister func(*WebsocketClient)) (*Websocket, error) {
+	ws := &Websocket{
 		Stack:           map[uint64]*WebsocketStack{},
-		Key:             key,
+		Users:           map[uint64]map[string]*WebsocketClient{},
+		Config:          NewWebsocketConfig(),
+		Name:            name,
+		Key:             uint64(time.Now().UnixNano()),
 		MaxCountInStack: 5000,
+		MinStacks:       1,
 		I:               0,
 		FuncRegister:    register,
 		FuncMessage:     message,
 		FuncUnregister:  unregister,
 	}
 
-	countStack := int(maxConnect / 5000)
-
-	if countStack < 50 {
-		countStack = 50
+	if err := websocketRegister(ws); err != nil {
+		return nil, err
 	}
 
-	for i := 0; i < countStack; i++ {
-		Websockets[key].NewWebsocketStack()
+	if wsConfig := ws.Config; wsConfig.ReplayAll || wsConfig.ReplayRooms {
+		ws.Replay = NewWebsocketReplay(wsConfig.ReplayAll, wsConfig.ReplayRooms, wsConfig.ReplaySize, wsConfig.ReplayMaxAge)
 	}
 
-	return Websockets[key]
-}
+	if ws.Config.StackSize > 0 {
+		ws.MaxCountInStack = ws.Config.StackSize
+	}
 
-func (wsStack *WebsocketStack) RunHub() {
-	stack := ClientsStack{
-		Clients: make(map[uint64]*WebsocketClient),
+	if ws.Config.Shards > 0 {
+		ws.MinStacks = ws.Config.Shards
 	}
 
-	// Проверяем работоспособность подключений
-	go func() {
-		ticker := time.NewTicker(60 * time.Second)
-		defer func() {
-			ticker.Stop()
-		}()
+	// Enough stacks for maxConnect, unless it is limited by the config
+	ws.MaxStacks = int((maxConnect + ws.MaxCountInStack - 1) / ws.MaxCountInStack)
 
-		for {
-			select {
-			case <-ticker.C:
-				t := time.Now().Unix()
+	if ws.Config.MaxShards > 0 {
+		ws.MaxStacks = ws.Config.MaxShards
+	}
 
-				for _, wsClient := range stack.Clients {
-					if t-wsClient.Time > config.PingPeriod {
-						atomic.SwapInt64(&wsClient.Time, time.Now().Unix())
+	if ws.MaxStacks < ws.MinStacks {
+		ws.MaxStacks = ws.MinStacks
+	}
 
-						go func() {
-							//fmt.Println("PING: ", wsClient.Key())
+	for i := 0; i < ws.MinStacks; i++ {
+		ws.NewWebsocketStack()
+	}
 
-							wsClient.Connect.SetWriteDeadline(time.Now().Add(config.WriteWait))
-							if err := wsClient.Connect.WriteMessage(websocket.PingMessage, nil); err != nil {
-								//fmt.Println("ERROR PING")
+	go ws.runStacks()
 
-								wsClient.Connect.WriteMessage(websocket.CloseMessage, []byte{})
-								wsClient.Connect.Close()
+	return ws, nil
+}
 
-								if stack.DeleteClient(wsClient.ClientKey) {
-									wsStack.CountDecrement()
-								}
-							}
-						}()
-					}
-				}
-			}
-		}
-	}()
+func (wsStack *WebsocketStack) RunHub() {
+	stack := ClientsStack{
+		Clients: make(map[uint64]*WebsocketClient),
+		Rooms:   make(map[string]map[uint64]*WebsocketClient),
+	}
 
 	for {
 		select {
 		case wsClient := <-wsStack.Register:
-			wsStack.CountIncrement()
+			// The place was reserved by selectStack
 			stack.Clients[wsClient.ClientKey] = wsClient
 
+			if wsClient.Replay && wsStack.Ws.Replay != nil {
+				messages, ok := wsStack.Ws.Replay.Since("", wsClient.Since)
+				wsClient.replay("", messages, ok)
+			}
+
 		case wsBroadcast := <-wsStack.Broadcast:
 			// Send the message to all clients
 
-			if wsBroadcast.ClientKey == 0 {
+			if wsBroadcast.Room != "" {
+				for _, wsClient := range stack.Rooms[wsBroadcast.Room] {
+					if !wsClient.Enqueue(wsBroadcast) {
+						wsClient.Close()
+
+						if stack.DeleteClient(wsClient.ClientKey) {
+							wsStack.CountDecrement()
+						}
+					}
+				}
+			} else if wsBroadcast.ClientKey == 0 {
 				for _, wsClient := range stack.Clients {
-					if !wsClient.Write(wsBroadcast.Message) {
-						wsClient.Connect.WriteMessage(websocket.CloseMessage, []byte{})
-						wsClient.Connect.Close()
+					if !wsClient.Enqueue(wsBroadcast) {
+						wsClient.Close()
 
 						if stack.DeleteClient(wsClient.ClientKey) {
 							wsStack.CountDecrement()
@@ -172,9 +223,8 @@ func (wsStack *WebsocketStack) RunHub() {
 					}
 				}
 			} else if wsClient, ok := stack.Clients[wsBroadcast.ClientKey]; ok {
-				if !wsClient.Write(wsBroadcast.Message) {
-					wsClient.Connect.WriteMessage(websocket.CloseMessage, []byte{})
-					wsClient.Connect.Close()
+				if !wsClient.Enqueue(wsBroadcast) {
+					wsClient.Close()
 
 					if stack.DeleteClient(wsClient.ClientKey) {
 						wsStack.CountDecrement()
@@ -186,37 +236,58 @@ func (wsStack *WebsocketStack) RunHub() {
 			if stack.DeleteClient(wsClient.ClientKey) {
 				wsStack.CountDecrement()
 			}
-		}
-	}
-}
+		case wsRoom := <-wsStack.Room:
+			if wsRoom.Join {
+				stack.JoinRoom(wsRoom.Client, wsRoom.Room)
 
-func (ws *Websocket) NewWebsocketClient(connection *websocket.Conn) (*WebsocketClient, error) {
-	var stack *WebsocketStack
-	var wsClient *WebsocketClient
-	var err error
+				if wsRoom.Client.Replay && wsStack.Ws.Replay != nil {
+					messages, ok := wsStack.Ws.Replay.Since(wsRoom.Room, wsRoom.Client.Since)
+					wsRoom.Client.replay(wsRoom.Room, messages, ok)
+				}
+			} else {
+				stack.LeaveRoom(wsRoom.Client, wsRoom.Room)
+			}
+		case list := <-wsStack.List:
+			wsClients := make([]*WebsocketClient, 0, len(stack.Clients))
 
-	if _, ok := ws.Stack[1]; ok {
-		stack = ws.Stack[1]
+			for _, wsClient := range stack.Clients {
+				wsClients = append(wsClients, wsClient)
+			}
 
-		for _, wsStack := range ws.Stack {
-			if wsStack.Count < stack.Count {
-				stack = wsStack
+			list <- wsClients
+		case reason := <-wsStack.Drain:
+			// Close every client, the route unregisters it when its read loop ends
+			for _, wsClient := range stack.Clients {
+				wsClient.CloseWithCode(websocket.CloseGoingAway, reason)
 			}
+		case <-wsStack.Done:
+			return
 		}
 	}
+}
 
-	wsClient, err = stack.NewWebsocketClient(connection)
-
-	return wsClient, err
+func (ws *Websocket) NewWebsocketClient(connection *websocket.Conn) (*WebsocketClient, error) {
+	return ws.selectStack().NewWebsocketClient(connection)
 }
 
 func (ws *Websocket) NewWebsocketStack() *WebsocketStack {
+	ws.StackMutex.Lock()
+	defer ws.StackMutex.Unlock()
+
+	return ws.newWebsocketStack()
+}
+
+func (ws *Websocket) newWebsocketStack() *WebsocketStack {
 	ws.I++
 	ws.Stack[ws.I] = &WebsocketStack{
 		Ws:         ws,
 		Register:   make(chan *WebsocketClient),
 		Broadcast:  make(chan *BroadcastWebsocket),
 		Unregister: make(chan *WebsocketClient),
+		Room:       make(chan *RoomWebsocket),
+		Drain:      make(chan string),
+		List:       make(chan chan []*WebsocketClient),
+		Done:       make(chan struct{}),
 		Count:      0,
 		I:          0,
 		Key:        ws.I,
@@ -237,79 +308,432 @@ func (wsStack *WebsocketStack) NewWebsocketClient(connection *websocket.Conn) (*
 	I := wsStack.I
 	wsStack.Mutex.Unlock()
 
-	wsClient, err = NewWebsocketClient(connection, wsStack.Ws.Key, wsStack.Key, I)
+	wsClient, err = NewWebsocketClient(connection, wsStack.Ws.Config, wsStack.Ws.Name, wsStack.Ws.Key, wsStack.Key, I)
 
 	return wsClient, err
 }
 
 func (ws *Websocket) Register(wsClient *WebsocketClient) {
-	if wsStack, ok := ws.Stack[wsClient.StackKey]; ok {
+	if wsStack, ok := ws.stack(wsClient.StackKey); ok {
 		atomic.SwapInt64(&wsClient.Time, time.Now().Unix())
 
-		wsStack.Register <- wsClient
+		go wsClient.RunWriter()
+
+		select {
+		case wsStack.Register <- wsClient:
+		case <-wsStack.Done:
+		}
+
+		ws.addUserClient(wsClient)
+
+		PresenceConnect(wsClient.UserId, PresenceTransportWs, wsClient.Key())
 
 		ws.FuncRegister(wsClient)
 	}
 }
 
-func (ws *Websocket) Broadcast(wsClient *WebsocketClient, s []byte) {
-	if _, ok := ws.Stack[wsClient.StackKey]; ok {
+// Handle serves the clients of the hub with the handler of all transports.
+func (ws *Websocket) Handle(handler ConnectionHandler) {
+	ws.FuncRegister = func(wsClient *WebsocketClient) {
+		handler.OnConnect(wsClient)
+	}
+
+	binaryHandler, _ := handler.(ConnectionBinaryHandler)
+
+	ws.FuncMessage = func(wsClient *WebsocketClient, messageType int, message []byte) {
+		if messageType != websocket.BinaryMessage {
+			handler.OnMessage(wsClient, message)
+		} else if binaryHandler != nil {
+			binaryHandler.OnBinaryMessage(wsClient, message)
+		}
+	}
+
+	ws.FuncUnregister = func(wsClient *WebsocketClient) {
+		handler.OnClose(wsClient)
+	}
+}
+
+// Broadcast passes a message of the client to FuncMessage. It returns false
+// when the client has to be disconnected.
+func (ws *Websocket) Broadcast(wsClient *WebsocketClient, messageType int, s []byte) bool {
+	if _, ok := ws.stack(wsClient.StackKey); ok {
 		atomic.SwapInt64(&wsClient.Time, time.Now().Unix())
 
-		ws.FuncMessage(wsClient, s)
+		switch ws.Config.RateLimit.Check(wsClient.Key(), wsClient.Ip) {
+		case RateLimitDrop:
+			return true
+		case RateLimitWarn:
+			if message, err := json.Marshal(&WebsocketRpcEnvelope{Event: RateLimitEvent}); err == nil {
+				wsClient.Enqueue(NewBroadcastWebsocket(0, 0, 0, message))
+			}
+
+			return true
+		case RateLimitDisconnect:
+			wsClient.CloseWithCode(websocket.ClosePolicyViolation, "rate limit exceeded")
+
+			return false
+		}
+
+		if ws.FuncFilter != nil {
+			s = ws.FuncFilter(messageType, s)
+		}
+
+		ws.FuncMessage(wsClient, messageType, s)
 	}
+
+	return true
 }
 
 func (ws *Websocket) Unregister(wsClient *WebsocketClient) {
-	if wsStack, ok := ws.Stack[wsClient.StackKey]; ok {
-		wsStack.Unregister <- wsClient
+	if wsStack, ok := ws.stack(wsClient.StackKey); ok {
+		select {
+		case wsStack.Unregister <- wsClient:
+		case <-wsStack.Done:
+		}
+
+		ws.deleteUserClient(wsClient)
+
+		ws.Config.RateLimit.Forget(wsClient.Key())
+
+		PresenceDisconnect(wsClient.UserId, PresenceTransportWs, wsClient.Key())
 
 		ws.FuncUnregister(wsClient)
 	}
 }
 
+func (ws *Websocket) addUserClient(wsClient *WebsocketClient) {
+	if wsClient.UserId == 0 {
+		return
+	}
+
+	ws.Mutex.Lock()
+	defer ws.Mutex.Unlock()
+
+	if _, ok := ws.Users[wsClient.UserId]; !ok {
+		ws.Users[wsClient.UserId] = map[string]*WebsocketClient{}
+	}
+
+	ws.Users[wsClient.UserId][wsClient.Key()] = wsClient
+}
+
+func (ws *Websocket) deleteUserClient(wsClient *WebsocketClient) {
+	if wsClient.UserId == 0 {
+		return
+	}
+
+	ws.Mutex.Lock()
+	defer ws.Mutex.Unlock()
+
+	if clients, ok := ws.Users[wsClient.UserId]; ok {
+		delete(clients, wsClient.Key())
+
+		if len(clients) == 0 {
+			delete(ws.Users, wsClient.UserId)
+		}
+	}
+}
+
+// UserClients returns every connection (browser tab) of the user.
+func (ws *Websocket) UserClients(userId uint64) []*WebsocketClient {
+	ws.Mutex.Lock()
+	defer ws.Mutex.Unlock()
+
+	clients := make([]*WebsocketClient, 0, len(ws.Users[userId]))
+
+	for _, wsClient := range ws.Users[userId] {
+		clients = append(clients, wsClient)
+	}
+
+	return clients
+}
+
+func (ws *Websocket) SendToUser(userId uint64, message any) {
+	for _, wsClient := range ws.UserClients(userId) {
+		ws.Send(wsClient.Key(), message)
+	}
+}
+
+// Clients returns the clients of all the stacks.
+func (ws *Websocket) Clients() []*WebsocketClient {
+	wsClients := []*WebsocketClient{}
+
+	for _, wsStack := range ws.Stacks() {
+		wsClients = append(wsClients, wsStack.Clients()...)
+	}
+
+	return wsClients
+}
+
+func (wsStack *WebsocketStack) Clients() []*WebsocketClient {
+	list := make(chan []*WebsocketClient, 1)
+
+	select {
+	case wsStack.List <- list:
+		return <-list
+	case <-wsStack.Done:
+		return nil
+	}
+}
+
+// Client returns the client with the key, nil if it is not connected to this websocket.
+func (ws *Websocket) Client(key string) *WebsocketClient {
+	if hub, wsKey, stackKey, _, ok := WebsocketParseKey(key); ok && hub == ws.Name && wsKey == ws.Key {
+		if wsStack, ok := ws.stack(stackKey); ok {
+			for _, wsClient := range wsStack.Clients() {
+				if wsClient.Key() == key {
+					return wsClient
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (ws *Websocket) Join(wsClient *WebsocketClient, room string) {
+	if wsStack, ok := ws.stack(wsClient.StackKey); ok {
+		select {
+		case wsStack.Room <- NewRoomWebsocket(wsClient, room, true):
+		case <-wsStack.Done:
+		}
+	}
+}
+
+func (ws *Websocket) Leave(wsClient *WebsocketClient, room string) {
+	if wsStack, ok := ws.stack(wsClient.StackKey); ok {
+		select {
+		case wsStack.Room <- NewRoomWebsocket(wsClient, room, false):
+		case <-wsStack.Done:
+		}
+	}
+}
+
+func (ws *Websocket) SendRoom(room string, message any) {
+	ws.broadcast(NewBroadcastRoomWebsocket(room, message))
+}
+
+func (ws *Websocket) SendRoomBinary(room string, message any) {
+	ws.broadcast(NewBroadcastRoomWebsocket(room, message).Binary())
+}
+
 func (ws *Websocket) SendAll(message any) {
-	wsBroadcast := NewBroadcastWebsocket(0, 0, 0, message)
+	ws.broadcast(NewBroadcastWebsocket(0, 0, 0, message))
+}
+
+func (ws *Websocket) SendAllBinary(message any) {
+	ws.broadcast(NewBroadcastWebsocket(0, 0, 0, message).Binary())
+}
+
+func (ws *Websocket) broadcast(wsBroadcast *BroadcastWebsocket) {
+	if ws.Replay != nil && ws.Replay.enabled(wsBroadcast) {
+		// The hubs have to get the messages in the order of their numbers
+		ws.Replay.order.Lock()
+		defer ws.Replay.order.Unlock()
 
-	for _, wsStack := range ws.Stack {
-		if wsStack.Count > 0 {
-			wsStack.Broadcast <- wsBroadcast
+		ws.Replay.store(wsBroadcast)
+	}
+
+	for _, wsStack := range ws.Stacks() {
+		if wsStack.CountGet() > 0 {
+			select {
+			case wsStack.Broadcast <- wsBroadcast:
+			case <-wsStack.Done:
+			}
 		}
 	}
 }
 
 func (ws *Websocket) Send(key string, message any) {
-	splitKey := strings.Split(key, ":")
-
-	if len(splitKey) == 4 {
-		if splitKey[0] == "ws" {
-			if wsKey, err := strconv.ParseUint(splitKey[1], 10, 64); err == nil {
-				if stackKey, err := strconv.ParseUint(splitKey[2], 10, 64); err == nil {
-					if clientKey, err := strconv.ParseUint(splitKey[3], 10, 64); err == nil {
-						if wsKey > 0 && stackKey > 0 && clientKey > 0 && ws.Key == wsKey {
-							if wsStack, ok := ws.Stack[stackKey]; ok {
-								if wsStack.Count > 0 {
-									wsBroadcast := NewBroadcastWebsocket(wsKey, stackKey, clientKey, message)
-
-									wsStack.Broadcast <- wsBroadcast
-								}
-							}
-						}
-					}
+	ws.send(key, websocket.TextMessage, message)
+}
+
+func (ws *Websocket) SendBinary(key string, message any) {
+	ws.send(key, websocket.BinaryMessage, message)
+}
+
+func (ws *Websocket) send(key string, messageType int, message any) bool {
+	if hub, wsKey, stackKey, clientKey, ok := WebsocketParseKey(key); ok && hub == ws.Name && wsKey == ws.Key {
+		if wsStack, ok := ws.stack(stackKey); ok {
+			if wsStack.CountGet() > 0 {
+				wsBroadcast := NewBroadcastWebsocket(wsKey, stackKey, clientKey, message)
+				wsBroadcast.MessageType = messageType
+
+				select {
+				case wsStack.Broadcast <- wsBroadcast:
+				case <-wsStack.Done:
 				}
 			}
+
+			return true
+		}
+	}
+
+	return false
+}
+
+func newWebsocketBackplaneMessage(hub string, action string, key string, messageType int, message any) *BackplaneMessage {
+	bpMessage := NewBackplaneMessage("ws", action, key, messageType, message)
+	bpMessage.Hub = hub
+
+	return bpMessage
+}
+
+// WebsocketSendAll sends the message to all the clients of the hub on every node.
+func WebsocketSendAll(hub string, message any) {
+	websocketRelay(newWebsocketBackplaneMessage(hub, BackplaneActionAll, "", websocket.TextMessage, message))
+}
+
+func WebsocketSendRoom(hub string, room string, message any) {
+	websocketRelay(newWebsocketBackplaneMessage(hub, BackplaneActionRoom, room, websocket.TextMessage, message))
+}
+
+func WebsocketSendToUser(hub string, userId uint64, message any) {
+	websocketRelay(newWebsocketBackplaneMessage(hub, BackplaneActionUser, strconv.FormatUint(userId, 10), websocket.TextMessage, message))
+}
+
+// WebsocketSend sends the message to the client with the key, the key names the hub.
+func WebsocketSend(key string, message any) {
+	hub, _, _, _, _ := WebsocketParseKey(key)
+
+	websocketRelay(newWebsocketBackplaneMessage(hub, BackplaneActionKey, key, websocket.TextMessage, message))
+}
+
+func WebsocketSendAllBinary(hub string, message any) {
+	websocketRelay(newWebsocketBackplaneMessage(hub, BackplaneActionAll, "", websocket.BinaryMessage, message))
+}
+
+func WebsocketSendRoomBinary(hub string, room string, message any) {
+	websocketRelay(newWebsocketBackplaneMessage(hub, BackplaneActionRoom, room, websocket.BinaryMessage, message))
+}
+
+func WebsocketSendBinary(key string, message any) {
+	hub, _, _, _, _ := WebsocketParseKey(key)
+
+	websocketRelay(newWebsocketBackplaneMessage(hub, BackplaneActionKey, key, websocket.BinaryMessage, message))
+}
+
+// WebsocketBackplaneReceive delivers a message published by another node.
+func WebsocketBackplaneReceive(bpMessage *BackplaneMessage) {
+	websocketDeliver(bpMessage)
+}
+
+func websocketRelay(bpMessage *BackplaneMessage) {
+	// A key-addressed message leaves the node only when the client is not here
+	if !websocketDeliver(bpMessage) || bpMessage.Action != BackplaneActionKey {
+		BackplanePublish(bpMessage)
+	}
+}
+
+// websocketDeliver sends the message to the clients of this node. It returns
+// true when the hub of a key-addressed message belongs to this node.
+func websocketDeliver(bpMessage *BackplaneMessage) bool {
+	ws := WebsocketHub(bpMessage.Hub)
+
+	if ws == nil {
+		return false
+	}
+
+	switch bpMessage.Action {
+	case BackplaneActionAll:
+		wsBroadcast := NewBroadcastWebsocket(0, 0, 0, bpMessage.Data)
+		wsBroadcast.MessageType = bpMessage.MessageType
+
+		ws.broadcast(wsBroadcast)
+	case BackplaneActionRoom:
+		wsBroadcast := NewBroadcastRoomWebsocket(bpMessage.Key, bpMessage.Data)
+		wsBroadcast.MessageType = bpMessage.MessageType
+
+		ws.broadcast(wsBroadcast)
+	case BackplaneActionUser:
+		if userId, err := strconv.ParseUint(bpMessage.Key, 10, 64); err == nil {
+			for _, wsClient := range ws.UserClients(userId) {
+				ws.send(wsClient.Key(), bpMessage.MessageType, bpMessage.Data)
+			}
 		}
+	case BackplaneActionKey:
+		return ws.send(bpMessage.Key, bpMessage.MessageType, bpMessage.Data)
 	}
+
+	return false
 }
 
-func WebsocketSendAll(message any) {
-	for i, _ := range Websockets {
-		Websockets[i].SendAll(message)
+// WebsocketFilterNewline is the old behaviour of the read loop: newlines of text
+// messages are replaced by spaces and the message is trimmed.
+func WebsocketFilterNewline(messageType int, message []byte) []byte {
+	if messageType != websocket.TextMessage {
+		return message
 	}
+
+	return bytes.TrimSpace(bytes.Replace(message, []byte{'\n'}, []byte{' '}, -1))
 }
 
-func WebsocketSend(key string, message any) {
-	for i, _ := range Websockets {
-		Websockets[i].Send(key, message)
+// WebsocketDrain closes the clients of all the websockets with "going away"
+// and waits until they are unregistered.
+func WebsocketDrain(ctx context.Context) {
+	for _, ws := range WebsocketHubs() {
+		for _, wsStack := range ws.Stacks() {
+			select {
+			case wsStack.Drain <- DrainReconnect:
+			case <-wsStack.Done:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+
+	drainWait(ctx, func() uint64 {
+		count := uint64(0)
+
+		for _, ws := range WebsocketHubs() {
+			for _, wsStack := range ws.Stacks() {
+				count += wsStack.CountGet()
+			}
+		}
+
+		return count
+	})
+}
+
+// WebsocketConnections lists and controls the clients of all the websockets for the admin.
+func WebsocketConnections() *ConnectionsProvider {
+	return &ConnectionsProvider{
+		List: func() []*ConnectionInfo {
+			connections := []*ConnectionInfo{}
+
+			for _, ws := range WebsocketHubs() {
+				for _, wsClient := range ws.Clients() {
+					connections = append(connections, &ConnectionInfo{
+						Transport: PresenceTransportWs,
+						Key:       wsClient.Key(),
+						Ip:        wsClient.Ip,
+						UserId:    wsClient.UserId,
+						ConnectAt: wsClient.ConnectAt,
+						ActiveAt:  time.Unix(atomic.LoadInt64(&wsClient.Time), 0),
+					})
+				}
+			}
+
+			return connections
+		},
+		Disconnect: func(key string) bool {
+			for _, ws := range WebsocketHubs() {
+				if wsClient := ws.Client(key); wsClient != nil {
+					wsClient.CloseWithCode(websocket.CloseNormalClosure, "disconnected")
+
+					return true
+				}
+			}
+
+			return false
+		},
+		Send: func(key string, message string) bool {
+			for _, ws := range WebsocketHubs() {
+				if ws.Client(key) != nil {
+					return ws.send(key, websocket.TextMessage, message)
+				}
+			}
+
+			return false
+		},
 	}
 }
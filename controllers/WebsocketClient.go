@@ -3,6 +3,7 @@ package controllers
 import (
 	"errors"
 	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -11,54 +12,200 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+const (
+	WebsocketQueueDropOldest = "drop_oldest"
+	WebsocketQueueDropNewest = "drop_newest"
+	WebsocketQueueDisconnect = "disconnect"
+)
+
 type WebsocketClient struct {
+	Mutex sync.Mutex
+
 	// The websocket connection.
 	Connect *websocket.Conn
 
-	Time int64
+	// Rooms the client has joined, maintained by the stack hub.
+	Rooms map[string]bool
+
+	// Outbound messages, drained by the client's own writer goroutine.
+	Queue       chan *BroadcastWebsocket
+	QueuePolicy string
+	Closed      chan struct{}
+	closeOnce   sync.Once
+	closeCode   int
+	closeText   string
+
+	// Unix time of the last activity
+	Time      int64
+	ConnectAt time.Time
+
+	Config *WebsocketConfig
+
+	// Id of the authorized models.User, 0 for guests.
+	UserId uint64
 
+	// Remote IP address, used by the rate limit.
+	Ip string
+
+	// The client reconnected with ?since=<seq>: it gets the missed messages
+	// and the numbered messages as {"event": "message", "seq": ..., "data": ...}.
+	Replay  bool
+	Since   uint64
+	lastSeq map[string]uint64
+
+	// The replays of the hub, written before the queue by the writer
+	replays     []*websocketReplayBatch
+	replayReady chan struct{}
+
+	Hub       string
 	WsKey     uint64
 	StackKey  uint64
 	ClientKey uint64
 }
 
-func NewWebsocketClient(connect *websocket.Conn, wsKey uint64, stackKey uint64, clientKey uint64) (*WebsocketClient, error) {
+// NewWebsocketClient creates a client with the config of its hub, a default
+// one for nil.
+func NewWebsocketClient(connect *websocket.Conn, wsConfig *WebsocketConfig, hub string, wsKey uint64, stackKey uint64, clientKey uint64) (*WebsocketClient, error) {
 	var err error
 
 	if connect == nil {
 		err = errors.New("No WebsocketStack")
 	}
 
+	if wsConfig == nil {
+		wsConfig = NewWebsocketConfig()
+	}
+
 	wsClient := &WebsocketClient{
 		Connect:   connect,
+		Config:    wsConfig,
+		Hub:       hub,
 		WsKey:     wsKey,
 		StackKey:  stackKey,
 		ClientKey: clientKey,
+		Rooms:     map[string]bool{},
+		lastSeq:   map[string]uint64{},
+		ConnectAt: time.Now(),
+
+		replayReady: make(chan struct{}, 1),
+
+		Queue:       make(chan *BroadcastWebsocket, config.WsSendQueueSize),
+		QueuePolicy: config.WsSendQueuePolicy,
+		Closed:      make(chan struct{}),
 	}
 
 	return wsClient, err
 }
 
 func (wsClient *WebsocketClient) Key() string {
-	return fmt.Sprintf("ws:%d:%d:%d", wsClient.WsKey, wsClient.StackKey, wsClient.ClientKey)
+	return fmt.Sprintf("ws:%s:%d:%d:%d", wsClient.Hub, wsClient.WsKey, wsClient.StackKey, wsClient.ClientKey)
 }
 
+// SendAll sends the message to all the clients of the hub of the client.
 func (wsClient *WebsocketClient) SendAll(message any) {
-	if ws, ok := Websockets[wsClient.WsKey]; ok {
-		ws.SendAll(message)
-	}
+	WebsocketSendAll(wsClient.Hub, message)
+}
+
+func (wsClient *WebsocketClient) SendTo(key string, message any) {
+	WebsocketSend(key, message)
 }
 
+// Send sends the message to the client with the key.
+//
+// Deprecated: use SendTo, or SendMessage for this client.
 func (wsClient *WebsocketClient) Send(key string, message any) {
-	if ws, ok := Websockets[wsClient.WsKey]; ok {
-		ws.Send(key, message)
+	WebsocketSend(key, message)
+}
+
+// SendMessage puts the text message into the queue of the client.
+func (wsClient *WebsocketClient) SendMessage(message any) bool {
+	if !wsClient.Enqueue(NewBroadcastWebsocket(wsClient.WsKey, wsClient.StackKey, wsClient.ClientKey, message)) {
+		wsClient.Close()
+
+		return false
+	}
+
+	return true
+}
+
+func (wsClient *WebsocketClient) Transport() string {
+	return PresenceTransportWs
+}
+
+func (wsClient *WebsocketClient) User() uint64 {
+	return wsClient.UserId
+}
+
+func (wsClient *WebsocketClient) setRoom(room string, join bool) {
+	wsClient.Mutex.Lock()
+	defer wsClient.Mutex.Unlock()
+
+	if join {
+		wsClient.Rooms[room] = true
+	} else {
+		delete(wsClient.Rooms, room)
+	}
+}
+
+func (wsClient *WebsocketClient) InRoom(room string) bool {
+	wsClient.Mutex.Lock()
+	defer wsClient.Mutex.Unlock()
+
+	_, ok := wsClient.Rooms[room]
+
+	return ok
+}
+
+func (wsClient *WebsocketClient) RoomList() []string {
+	wsClient.Mutex.Lock()
+	defer wsClient.Mutex.Unlock()
+
+	rooms := make([]string, 0, len(wsClient.Rooms))
+
+	for room, _ := range wsClient.Rooms {
+		rooms = append(rooms, room)
 	}
+
+	return rooms
+}
+
+func (wsClient *WebsocketClient) Join(room string) {
+	if ws := WebsocketHub(wsClient.Hub); ws != nil {
+		ws.Join(wsClient, room)
+	}
+}
+
+func (wsClient *WebsocketClient) Leave(room string) {
+	if ws := WebsocketHub(wsClient.Hub); ws != nil {
+		ws.Leave(wsClient, room)
+	}
+}
+
+func (wsClient *WebsocketClient) SendRoom(room string, message any) {
+	WebsocketSendRoom(wsClient.Hub, room, message)
+}
+
+func (wsClient *WebsocketClient) SendBinaryTo(key string, message any) {
+	WebsocketSendBinary(key, message)
+}
+
+// Deprecated: use SendBinaryTo.
+func (wsClient *WebsocketClient) SendBinary(key string, message any) {
+	WebsocketSendBinary(key, message)
+}
+
+func (wsClient *WebsocketClient) SendAllBinary(message any) {
+	WebsocketSendAllBinary(wsClient.Hub, message)
 }
 
 func (wsClient *WebsocketClient) Write(message []byte) bool {
-	wsClient.Connect.SetWriteDeadline(time.Now().Add(config.WriteWait))
+	return wsClient.WriteType(websocket.TextMessage, message)
+}
 
-	writer, err := wsClient.Connect.NextWriter(websocket.TextMessage)
+func (wsClient *WebsocketClient) WriteType(messageType int, message []byte) bool {
+	wsClient.Connect.SetWriteDeadline(time.Now().Add(wsClient.Config.WriteWait))
+
+	writer, err := wsClient.Connect.NextWriter(messageType)
 	if err == nil {
 		_, err = writer.Write(message)
 
@@ -73,3 +220,177 @@ func (wsClient *WebsocketClient) Write(message []byte) bool {
 		return false
 	}
 }
+
+// Enqueue puts the message into the outbound queue without blocking.
+// It returns false when the client has to be disconnected.
+func (wsClient *WebsocketClient) Enqueue(message *BroadcastWebsocket) bool {
+	select {
+	case <-wsClient.Closed:
+		return false
+	default:
+	}
+
+	select {
+	case wsClient.Queue <- message:
+		return true
+	default:
+	}
+
+	switch wsClient.QueuePolicy {
+	case WebsocketQueueDropNewest:
+		return true
+	case WebsocketQueueDisconnect:
+		return false
+	default:
+		select {
+		case <-wsClient.Queue:
+		default:
+		}
+
+		select {
+		case wsClient.Queue <- message:
+		default:
+		}
+
+		return true
+	}
+}
+
+// RunWriter is the only goroutine that writes to the connection.
+func (wsClient *WebsocketClient) RunWriter() {
+	ticker := time.NewTicker(wsClient.Config.PingPeriod)
+	defer func() {
+		ticker.Stop()
+
+		closeMessage := []byte{}
+
+		wsClient.Mutex.Lock()
+		if wsClient.closeCode != 0 {
+			closeMessage = websocket.FormatCloseMessage(wsClient.closeCode, wsClient.closeText)
+		}
+		wsClient.Mutex.Unlock()
+
+		wsClient.Connect.SetWriteDeadline(time.Now().Add(wsClient.Config.WriteWait))
+		wsClient.Connect.WriteMessage(websocket.CloseMessage, closeMessage)
+		wsClient.Connect.Close()
+	}()
+
+	for {
+		select {
+		case <-wsClient.replayReady:
+			if !wsClient.writeReplays() {
+				wsClient.Close()
+				return
+			}
+		case message := <-wsClient.Queue:
+			// A replay goes before the messages queued after it
+			select {
+			case <-wsClient.replayReady:
+				if !wsClient.writeReplays() {
+					wsClient.Close()
+					return
+				}
+			default:
+			}
+
+			data := message.Message
+
+			if message.Seq > 0 && wsClient.Replay {
+				// Skip what was already sent by the replay
+				if message.Seq <= wsClient.lastSeq[message.Room] {
+					continue
+				}
+
+				wsClient.lastSeq[message.Room] = message.Seq
+				data = websocketReplayFrame(message)
+			}
+
+			if !wsClient.WriteType(message.MessageType, data) {
+				wsClient.Close()
+				return
+			}
+		case <-ticker.C:
+			wsClient.Connect.SetWriteDeadline(time.Now().Add(wsClient.Config.WriteWait))
+			if err := wsClient.Connect.WriteMessage(websocket.PingMessage, nil); err != nil {
+				wsClient.Close()
+				return
+			}
+		case <-wsClient.Closed:
+			return
+		}
+	}
+}
+
+func (wsClient *WebsocketClient) Close() {
+	wsClient.closeOnce.Do(func() {
+		close(wsClient.Closed)
+	})
+}
+
+// CloseWithCode closes the connection with the close code and the reason,
+// for example websocket.ClosePolicyViolation.
+func (wsClient *WebsocketClient) CloseWithCode(code int, text string) {
+	wsClient.Mutex.Lock()
+	if wsClient.closeCode == 0 {
+		wsClient.closeCode = code
+		wsClient.closeText = text
+	}
+	wsClient.Mutex.Unlock()
+
+	wsClient.Close()
+}
+
+type websocketReplayBatch struct {
+	Room     string
+	Messages []*BroadcastWebsocket
+	Reset    bool
+}
+
+// replay hands the missed messages of the room to the writer. They do not go
+// through the queue, which is smaller than the buffer of the replay. Without
+// all of them the client gets the reset event instead.
+func (wsClient *WebsocketClient) replay(room string, messages []*BroadcastWebsocket, ok bool) {
+	wsClient.Mutex.Lock()
+	wsClient.replays = append(wsClient.replays, &websocketReplayBatch{
+		Room:     room,
+		Messages: messages,
+		Reset:    !ok,
+	})
+	wsClient.Mutex.Unlock()
+
+	select {
+	case wsClient.replayReady <- struct{}{}:
+	default:
+	}
+}
+
+func (wsClient *WebsocketClient) writeReplays() bool {
+	wsClient.Mutex.Lock()
+	replays := wsClient.replays
+	wsClient.replays = nil
+	wsClient.Mutex.Unlock()
+
+	for _, batch := range replays {
+		if batch.Reset {
+			if !wsClient.WriteType(websocket.TextMessage, websocketResetFrame(batch.Room, wsClient.Since)) {
+				return false
+			}
+
+			continue
+		}
+
+		for _, message := range batch.Messages {
+			if message.Seq <= wsClient.lastSeq[message.Room] {
+				continue
+			}
+
+			wsClient.lastSeq[message.Room] = message.Seq
+
+			if !wsClient.WriteType(message.MessageType, websocketReplayFrame(message)) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
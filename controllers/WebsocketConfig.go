@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"backnet/config"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebsocketConfig holds the limits of one websocket route.
+type WebsocketConfig struct {
+	MaxMessageSize    int64
+	ReadBufferSize    int
+	WriteBufferSize   int
+	WriteWait         time.Duration
+	PongWait          time.Duration
+	PingPeriod        time.Duration
+	EnableCompression bool
+	CompressionLevel  int
+	RateLimit         *RateLimit
+	ReplayAll         bool
+	ReplayRooms       bool
+	ReplaySize        int
+	ReplayMaxAge      time.Duration
+	Shards            int
+	MaxShards         int
+	StackSize         uint64
+}
+
+// NewWebsocketConfig copies the global defaults from config.
+func NewWebsocketConfig() *WebsocketConfig {
+	return &WebsocketConfig{
+		MaxMessageSize:    config.MaxMessageSize,
+		ReadBufferSize:    config.WsReadBufferSize,
+		WriteBufferSize:   config.WsWriteBufferSize,
+		WriteWait:         config.WriteWait,
+		PongWait:          config.PongWait,
+		PingPeriod:        time.Duration(config.PingPeriod),
+		EnableCompression: config.WsEnableCompression,
+		CompressionLevel:  config.WsCompressionLevel,
+		RateLimit:         NewRateLimit(config.WsRate, config.WsRateBurst, config.WsRateIp, config.WsRateIpBurst, config.WsRatePolicy),
+		ReplayAll:         config.WsReplayAll,
+		ReplayRooms:       config.WsReplayRooms,
+		ReplaySize:        config.WsReplaySize,
+		ReplayMaxAge:      config.WsReplayMaxAge,
+		Shards:            config.WsShards,
+		MaxShards:         config.WsMaxShards,
+		StackSize:         config.WsStackSize,
+	}
+}
+
+func (wsConfig *WebsocketConfig) Upgrader(checkOrigin func(r *http.Request) bool) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    wsConfig.ReadBufferSize,
+		WriteBufferSize:   wsConfig.WriteBufferSize,
+		EnableCompression: wsConfig.EnableCompression,
+		CheckOrigin:       checkOrigin,
+	}
+}
+
+// Prepare applies the read limits and the compression level to the upgraded connection.
+func (wsConfig *WebsocketConfig) Prepare(connect *websocket.Conn) {
+	connect.SetReadLimit(wsConfig.MaxMessageSize)
+	connect.SetReadDeadline(time.Now().Add(wsConfig.PongWait))
+	connect.SetPongHandler(func(string) error {
+		connect.SetReadDeadline(time.Now().Add(wsConfig.PongWait))
+		return nil
+	})
+
+	if wsConfig.EnableCompression {
+		connect.SetCompressionLevel(wsConfig.CompressionLevel)
+	}
+}
@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Websockets is the registry of the hubs by name. Every hub has its own
+// handlers, limits and route, and its name is a part of the client keys:
+// ws:<name>:<hub key>:<stack>:<client>.
+var Websockets map[string]*Websocket
+
+var websocketsMutex sync.RWMutex
+
+func websocketRegister(ws *Websocket) error {
+	if ws.Name == "" || strings.Contains(ws.Name, ":") {
+		return fmt.Errorf("Websocket name %q is not valid", ws.Name)
+	}
+
+	websocketsMutex.Lock()
+	defer websocketsMutex.Unlock()
+
+	if Websockets == nil {
+		Websockets = make(map[string]*Websocket)
+	}
+
+	if _, ok := Websockets[ws.Name]; ok {
+		return fmt.Errorf("Websocket %s already exists", ws.Name)
+	}
+
+	Websockets[ws.Name] = ws
+
+	return nil
+}
+
+// WebsocketHub returns the hub with the name, nil if there is none.
+func WebsocketHub(name string) *Websocket {
+	websocketsMutex.RLock()
+	defer websocketsMutex.RUnlock()
+
+	return Websockets[name]
+}
+
+// WebsocketHubs returns all the hubs sorted by name.
+func WebsocketHubs() []*Websocket {
+	websocketsMutex.RLock()
+	hubs := make([]*Websocket, 0, len(Websockets))
+
+	for _, ws := range Websockets {
+		hubs = append(hubs, ws)
+	}
+	websocketsMutex.RUnlock()
+
+	sort.Slice(hubs, func(i, j int) bool {
+		return hubs[i].Name < hubs[j].Name
+	})
+
+	return hubs
+}
+
+// WebsocketParseKey splits a client key into the hub name and the numbers.
+func WebsocketParseKey(key string) (hub string, wsKey uint64, stackKey uint64, clientKey uint64, ok bool) {
+	splitKey := strings.Split(key, ":")
+
+	if len(splitKey) == 5 {
+		if splitKey[0] == "ws" && splitKey[1] != "" {
+			if wsKey, err := strconv.ParseUint(splitKey[2], 10, 64); err == nil {
+				if stackKey, err := strconv.ParseUint(splitKey[3], 10, 64); err == nil {
+					if clientKey, err := strconv.ParseUint(splitKey[4], 10, 64); err == nil {
+						if wsKey > 0 && stackKey > 0 && clientKey > 0 {
+							return splitKey[1], wsKey, stackKey, clientKey, true
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return "", 0, 0, 0, false
+}
@@ -0,0 +1,223 @@
+package controllers
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Event of the frames of the clients that reconnected with ?since=<seq>.
+const WebsocketReplayEvent = "message"
+
+// Event sent instead of the replay of a room when the buffer no longer has the
+// messages after ?since=, the client has to reload the state of the room.
+const WebsocketResetEvent = "reset"
+
+// WebsocketReplay keeps the last text messages sent to all clients and to
+// rooms, so that a reconnecting client gets what it missed. Every message gets
+// a sequence number, unique in the websocket.
+type WebsocketReplay struct {
+	All    bool
+	Rooms  bool
+	Size   int
+	MaxAge time.Duration
+
+	seq      uint64
+	buffers  map[string]*websocketReplayBuffer
+	expireAt time.Time
+
+	// The sequence number of the last message of the removed rooms
+	dropped uint64
+
+	// Keeps the order of the sequence numbers in the hubs
+	order sync.Mutex
+	mutex sync.Mutex
+}
+
+type websocketReplayBuffer struct {
+	messages []*BroadcastWebsocket
+
+	// The sequence number of the last message removed from the buffer
+	dropped uint64
+}
+
+func NewWebsocketReplay(all bool, rooms bool, size int, maxAge time.Duration) *WebsocketReplay {
+	if size < 1 {
+		size = 1
+	}
+
+	return &WebsocketReplay{
+		All:     all,
+		Rooms:   rooms,
+		Size:    size,
+		MaxAge:  maxAge,
+		buffers: map[string]*websocketReplayBuffer{},
+	}
+}
+
+func (replay *WebsocketReplay) enabled(wsBroadcast *BroadcastWebsocket) bool {
+	if wsBroadcast.MessageType != websocket.TextMessage || wsBroadcast.ClientKey != 0 {
+		return false
+	}
+
+	return replay.room(wsBroadcast.Room)
+}
+
+func (replay *WebsocketReplay) room(room string) bool {
+	if room != "" {
+		return replay.Rooms
+	}
+
+	return replay.All
+}
+
+// store numbers the message and puts it into the buffer of its room, "" for all.
+func (replay *WebsocketReplay) store(wsBroadcast *BroadcastWebsocket) {
+	replay.mutex.Lock()
+	defer replay.mutex.Unlock()
+
+	replay.seq++
+
+	wsBroadcast.Seq = replay.seq
+	wsBroadcast.Time = time.Now()
+
+	buffer := replay.buffers[wsBroadcast.Room]
+
+	if buffer == nil {
+		buffer = &websocketReplayBuffer{}
+		replay.buffers[wsBroadcast.Room] = buffer
+	}
+
+	buffer.messages = append(buffer.messages, wsBroadcast)
+
+	if len(buffer.messages) > replay.Size {
+		replay.drop(buffer, len(buffer.messages)-replay.Size)
+	}
+
+	replay.expire()
+}
+
+func (replay *WebsocketReplay) drop(buffer *websocketReplayBuffer, count int) {
+	buffer.dropped = buffer.messages[count-1].Seq
+	buffer.messages = buffer.messages[count:]
+}
+
+// expire forgets the messages older than MaxAge and the rooms without messages.
+func (replay *WebsocketReplay) expire() {
+	// Once a second is enough, every store would have to walk all the rooms
+	if replay.MaxAge <= 0 || time.Now().Before(replay.expireAt) {
+		return
+	}
+
+	replay.expireAt = time.Now().Add(time.Second)
+
+	for room := range replay.buffers {
+		replay.expireRoom(room)
+	}
+}
+
+func (replay *WebsocketReplay) expireRoom(room string) {
+	buffer := replay.buffers[room]
+
+	if replay.MaxAge <= 0 || buffer == nil {
+		return
+	}
+
+	expired := time.Now().Add(-replay.MaxAge)
+	i := 0
+
+	for i < len(buffer.messages) && buffer.messages[i].Time.Before(expired) {
+		i++
+	}
+
+	if i > 0 {
+		replay.drop(buffer, i)
+	}
+
+	if len(buffer.messages) == 0 {
+		if buffer.dropped > replay.dropped {
+			replay.dropped = buffer.dropped
+		}
+
+		delete(replay.buffers, room)
+	}
+}
+
+// Since returns the messages of the room after seq that are not older than
+// MaxAge. It is false when some of them were already removed.
+func (replay *WebsocketReplay) Since(room string, seq uint64) ([]*BroadcastWebsocket, bool) {
+	replay.mutex.Lock()
+	defer replay.mutex.Unlock()
+
+	messages := []*BroadcastWebsocket{}
+
+	if !replay.room(room) {
+		return messages, true
+	}
+
+	replay.expire()
+	replay.expireRoom(room)
+
+	buffer := replay.buffers[room]
+
+	if buffer == nil {
+		return messages, seq >= replay.dropped
+	}
+
+	if seq < buffer.dropped {
+		return nil, false
+	}
+
+	for _, wsBroadcast := range buffer.messages {
+		if wsBroadcast.Seq > seq {
+			messages = append(messages, wsBroadcast)
+		}
+	}
+
+	return messages, true
+}
+
+// Seq returns the sequence number of the last message.
+func (replay *WebsocketReplay) Seq() uint64 {
+	replay.mutex.Lock()
+	defer replay.mutex.Unlock()
+
+	return replay.seq
+}
+
+// websocketReplayFrame wraps a numbered message for a client with replay:
+// {"event": "message", "seq": 12, "room": "...", "data": ...}
+func websocketReplayFrame(wsBroadcast *BroadcastWebsocket) []byte {
+	envelope := &WebsocketRpcEnvelope{
+		Event: WebsocketReplayEvent,
+		Seq:   wsBroadcast.Seq,
+		Room:  wsBroadcast.Room,
+	}
+
+	if json.Valid(wsBroadcast.Message) {
+		envelope.Data = wsBroadcast.Message
+	} else if data, err := json.Marshal(string(wsBroadcast.Message)); err == nil {
+		envelope.Data = data
+	}
+
+	message, err := json.Marshal(envelope)
+	if err != nil {
+		return wsBroadcast.Message
+	}
+
+	return message
+}
+
+// websocketResetFrame tells the client that the messages of the room after seq are lost:
+// {"event": "reset", "seq": 12, "room": "..."}
+func websocketResetFrame(room string, seq uint64) []byte {
+	message, _ := json.Marshal(&WebsocketRpcEnvelope{
+		Event: WebsocketResetEvent,
+		Seq:   seq,
+		Room:  room,
+	})
+
+	return message
+}
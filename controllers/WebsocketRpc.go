@@ -0,0 +1,224 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const WebsocketRpcAck = "ack"
+
+// WebsocketRpcEnvelope is a frame of the protocol: {"id", "event", "data"}.
+// Replies use the event "ack" and the id of the request.
+type WebsocketRpcEnvelope struct {
+	Id    string          `json:"id,omitempty"`
+	Event string          `json:"event"`
+	Seq   uint64          `json:"seq,omitempty"`
+	Room  string          `json:"room,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+type WebsocketRpcRequest struct {
+	Rpc    *WebsocketRpc
+	Client *WebsocketClient
+	Id     string
+	Event  string
+	Data   json.RawMessage
+	acked  bool
+	async  bool
+}
+
+type WebsocketRpc struct {
+	Mutex    sync.Mutex
+	Handlers map[string]func(*WebsocketRpcRequest)
+	Pending  map[string]chan *WebsocketRpcEnvelope
+	I        uint64
+	Timeout  time.Duration
+
+	// Called for the messages that are not an envelope
+	FuncMessage func(*WebsocketClient, int, []byte)
+}
+
+func NewWebsocketRpc(message func(*WebsocketClient, int, []byte)) *WebsocketRpc {
+	return &WebsocketRpc{
+		Handlers:    map[string]func(*WebsocketRpcRequest){},
+		Pending:     map[string]chan *WebsocketRpcEnvelope{},
+		Timeout:     10 * time.Second,
+		FuncMessage: message,
+	}
+}
+
+// On registers the handler of the event, like a route.
+func (rpc *WebsocketRpc) On(event string, handler func(*WebsocketRpcRequest)) {
+	rpc.Mutex.Lock()
+	defer rpc.Mutex.Unlock()
+
+	rpc.Handlers[event] = handler
+}
+
+// OnMessage dispatches an incoming frame. It fits Websocket.FuncMessage.
+func (rpc *WebsocketRpc) OnMessage(wsClient *WebsocketClient, messageType int, message []byte) {
+	envelope := &WebsocketRpcEnvelope{}
+
+	if messageType != websocket.TextMessage || json.Unmarshal(message, envelope) != nil || envelope.Event == "" {
+		if rpc.FuncMessage != nil {
+			rpc.FuncMessage(wsClient, messageType, message)
+		}
+		return
+	}
+
+	if envelope.Event == WebsocketRpcAck {
+		rpc.Mutex.Lock()
+		pending, ok := rpc.Pending[rpc.pendingKey(wsClient, envelope.Id)]
+		rpc.Mutex.Unlock()
+
+		if ok {
+			select {
+			case pending <- envelope:
+			default:
+			}
+		}
+		return
+	}
+
+	rpc.Mutex.Lock()
+	handler, ok := rpc.Handlers[envelope.Event]
+	rpc.Mutex.Unlock()
+
+	request := &WebsocketRpcRequest{
+		Rpc:    rpc,
+		Client: wsClient,
+		Id:     envelope.Id,
+		Event:  envelope.Event,
+		Data:   envelope.Data,
+	}
+
+	if !ok {
+		request.Error(fmt.Errorf("unknown event %s", envelope.Event))
+		return
+	}
+
+	handler(request)
+
+	// Every request with an id gets an answer, the async ones from their goroutine
+	if !request.async && !request.acked {
+		request.Ack(nil)
+	}
+}
+
+func (rpc *WebsocketRpc) pendingKey(wsClient *WebsocketClient, id string) string {
+	return wsClient.Key() + "|" + id
+}
+
+// Emit sends an event without waiting for the answer.
+func (rpc *WebsocketRpc) Emit(key string, event string, data any) error {
+	return rpc.send(key, &WebsocketRpcEnvelope{Event: event}, data)
+}
+
+// Request sends an event to the client and waits for its ack. The ack is read
+// by the read loop of the client, so do not call it from the client's own handlers
+// but from request.Go.
+func (rpc *WebsocketRpc) Request(wsClient *WebsocketClient, event string, data any, timeout time.Duration) (json.RawMessage, error) {
+	if timeout <= 0 {
+		timeout = rpc.Timeout
+	}
+
+	id := fmt.Sprintf("srv:%d", atomic.AddUint64(&rpc.I, 1))
+	key := rpc.pendingKey(wsClient, id)
+	pending := make(chan *WebsocketRpcEnvelope, 1)
+
+	rpc.Mutex.Lock()
+	rpc.Pending[key] = pending
+	rpc.Mutex.Unlock()
+
+	defer func() {
+		rpc.Mutex.Lock()
+		delete(rpc.Pending, key)
+		rpc.Mutex.Unlock()
+	}()
+
+	if err := rpc.send(wsClient.Key(), &WebsocketRpcEnvelope{Id: id, Event: event}, data); err != nil {
+		return nil, err
+	}
+
+	select {
+	case envelope := <-pending:
+		if envelope.Error != "" {
+			return envelope.Data, errors.New(envelope.Error)
+		}
+
+		return envelope.Data, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("rpc request %s timed out", event)
+	}
+}
+
+func (rpc *WebsocketRpc) send(key string, envelope *WebsocketRpcEnvelope, data any) error {
+	if data != nil {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+
+		envelope.Data = payload
+	}
+
+	message, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	WebsocketSend(key, message)
+
+	return nil
+}
+
+// Go runs the rest of a handler that waits in a goroutine, so that the read
+// loop of the client goes on. The request is answered from the goroutine.
+func (request *WebsocketRpcRequest) Go(handler func()) {
+	request.async = true
+
+	go func() {
+		handler()
+
+		if !request.acked {
+			request.Ack(nil)
+		}
+	}()
+}
+
+// Bind decodes the data of the request into v.
+func (request *WebsocketRpcRequest) Bind(v any) error {
+	if len(request.Data) == 0 {
+		return errors.New("rpc request has no data")
+	}
+
+	return json.Unmarshal(request.Data, v)
+}
+
+// Ack answers the request. Requests without an id are not answered.
+func (request *WebsocketRpcRequest) Ack(data any) error {
+	if request.acked || request.Id == "" {
+		return nil
+	}
+
+	request.acked = true
+
+	return request.Rpc.send(request.Client.Key(), &WebsocketRpcEnvelope{Id: request.Id, Event: WebsocketRpcAck}, data)
+}
+
+func (request *WebsocketRpcRequest) Error(err error) error {
+	if request.acked || request.Id == "" {
+		return nil
+	}
+
+	request.acked = true
+
+	return request.Rpc.send(request.Client.Key(), &WebsocketRpcEnvelope{Id: request.Id, Event: WebsocketRpcAck, Error: err.Error()}, nil)
+}
@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"time"
+)
+
+// How often the empty stacks above MinStacks are retired
+const WebsocketStacksRetireInterval = time.Minute
+
+func (ws *Websocket) stack(key uint64) (*WebsocketStack, bool) {
+	ws.StackMutex.RLock()
+	defer ws.StackMutex.RUnlock()
+
+	wsStack, ok := ws.Stack[key]
+
+	return wsStack, ok
+}
+
+// Stacks returns the running stacks.
+func (ws *Websocket) Stacks() []*WebsocketStack {
+	ws.StackMutex.RLock()
+	defer ws.StackMutex.RUnlock()
+
+	stacks := make([]*WebsocketStack, 0, len(ws.Stack))
+
+	for _, wsStack := range ws.Stack {
+		stacks = append(stacks, wsStack)
+	}
+
+	return stacks
+}
+
+// selectStack reserves a place for a new client in the least loaded stack.
+// When every stack has MaxCountInStack clients a new one is started, up to MaxStacks.
+func (ws *Websocket) selectStack() *WebsocketStack {
+	ws.StackMutex.Lock()
+	defer ws.StackMutex.Unlock()
+
+	var stack *WebsocketStack
+	var count uint64
+
+	for _, wsStack := range ws.Stack {
+		if wsCount := wsStack.CountGet(); stack == nil || wsCount < count {
+			stack = wsStack
+			count = wsCount
+		}
+	}
+
+	if (stack == nil || count >= ws.MaxCountInStack) && len(ws.Stack) < ws.MaxStacks {
+		stack = ws.newWebsocketStack()
+	}
+
+	stack.CountIncrement()
+
+	return stack
+}
+
+func (ws *Websocket) runStacks() {
+	ticker := time.NewTicker(WebsocketStacksRetireInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ws.retireStacks()
+	}
+}
+
+// retireStacks stops the empty stacks started on demand.
+func (ws *Websocket) retireStacks() {
+	ws.StackMutex.Lock()
+	defer ws.StackMutex.Unlock()
+
+	for key, wsStack := range ws.Stack {
+		if len(ws.Stack) <= ws.MinStacks {
+			return
+		}
+
+		// Places are reserved under StackMutex, so an empty stack stays empty
+		if wsStack.CountGet() == 0 {
+			delete(ws.Stack, key)
+			close(wsStack.Done)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package admin
+
+import (
+	"backnet/controllers"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/bitly/go-simplejson"
+)
+
+type ControllerConnections struct {
+	controllers.Controller
+}
+
+func NewControllerConnections() ControllerConnections {
+	controller := ControllerConnections{}
+
+	return controller
+}
+
+// List returns the WebSocket, SSE and WebRTC connections of this node,
+// ?transport=ws|sse|webrtc narrows the list.
+func (сontroller ControllerConnections) List(w http.ResponseWriter, r *http.Request) {
+	request := controllers.NewRequest(w, r).Admin()
+	defer request.Store()
+
+	if !request.Valid {
+		return
+	}
+
+	payload, err := json.Marshal(controllers.ConnectionsList(r.URL.Query().Get("transport")))
+	if err != nil {
+		log.Println(err)
+		payload = []byte("[]")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
+
+func (сontroller ControllerConnections) Disconnect(w http.ResponseWriter, r *http.Request) {
+	request := controllers.NewRequest(w, r).Admin()
+	defer request.Store()
+
+	if !request.Valid {
+		return
+	}
+
+	r.ParseForm()
+
+	json := simplejson.New()
+
+	if r.Form.Get("key") != "" {
+		json.Set("ok", controllers.ConnectionDisconnect(r.Form.Get("key")))
+	} else {
+		json.Set("error", "key not")
+	}
+
+	payload, err := json.MarshalJSON()
+	if err != nil {
+		log.Println(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
+
+func (сontroller ControllerConnections) Send(w http.ResponseWriter, r *http.Request) {
+	request := controllers.NewRequest(w, r).Admin()
+	defer request.Store()
+
+	if !request.Valid {
+		return
+	}
+
+	r.ParseForm()
+
+	json := simplejson.New()
+
+	if r.Form.Get("key") != "" && r.Form.Get("data") != "" {
+		json.Set("ok", controllers.ConnectionSend(r.Form.Get("key"), r.Form.Get("data")))
+	} else {
+		json.Set("error", "key or data not")
+	}
+
+	payload, err := json.MarshalJSON()
+	if err != nil {
+		log.Println(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
@@ -0,0 +1,39 @@
+package realtime
+
+import (
+	"fmt"
+
+	"backnet/controllers"
+)
+
+// ControllerMain is the chat of the demo pages, served over websocket, SSE
+// and WebRTC data channels.
+type ControllerMain struct {
+	controllers.Controller
+}
+
+func NewControllerMain() ControllerMain {
+	controller := ControllerMain{}
+
+	return controller
+}
+
+func (сontroller ControllerMain) OnConnect(conn controllers.Connection) {
+	conn.SendAll(fmt.Sprint("connection registered: ", conn.Key()))
+}
+
+func (сontroller ControllerMain) OnMessage(conn controllers.Connection, message []byte) {
+	conn.SendMessage("send...")
+	conn.SendAll(message)
+}
+
+// OnBinaryMessage takes the binary frames of the websocket clients.
+func (сontroller ControllerMain) OnBinaryMessage(conn controllers.Connection, message []byte) {
+	if wsClient, ok := conn.(*controllers.WebsocketClient); ok {
+		wsClient.SendAllBinary(message)
+	}
+}
+
+func (сontroller ControllerMain) OnClose(conn controllers.Connection) {
+	conn.SendAll(fmt.Sprint("connection unregistered: ", conn.Key()))
+}
@@ -1,7 +1,6 @@
 package sse
 
 import (
-	"fmt"
 	"net/http"
 
 	"backnet/config"
@@ -36,16 +35,3 @@ func (сontroller ControllerMain) Index(w http.ResponseWriter, r *http.Request)
 		"SsesPort": config.Env("SSES_PORT"),
 	})
 }
-
-func (сontroller ControllerMain) OnConnect(sseConn *controllers.SseConnection) {
-	controllers.SseSendAll(fmt.Sprint("connection registered: ", sseConn.Key()))
-}
-
-func (сontroller ControllerMain) OnMessage(key string, data string) {
-	controllers.SseSend(key, "send...")
-	controllers.SseSendAll(data)
-}
-
-func (сontroller ControllerMain) OnClose(sseConn *controllers.SseConnection) {
-	controllers.SseSendAll(fmt.Sprint("connection unregistered: ", sseConn.Key()))
-}
@@ -2,7 +2,9 @@ package webrtc
 
 import (
 	"backnet/components"
+	"backnet/config"
 	"backnet/controllers"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -10,11 +12,11 @@ import (
 	"time"
 
 	"github.com/bitly/go-simplejson"
+	"github.com/pion/webrtc/v3"
 )
 
 const (
 	StorageVideoStream = 1
-	CameraVideoStream  = 2
 )
 
 type ControllerMain struct {
@@ -39,7 +41,8 @@ func (сontroller ControllerMain) Index(w http.ResponseWriter, r *http.Request)
 		"views/layouts/main.html",
 		"views/webrtc/index.html",
 	}, 200, map[string]any{
-		"Title": "Video",
+		"Title":      "Video",
+		"IceServers": WebrtcIceServers(сontroller.userId(request)),
 	})
 }
 
@@ -55,7 +58,8 @@ func (сontroller ControllerMain) Cam(w http.ResponseWriter, r *http.Request) {
 		"views/layouts/main.html",
 		"views/webrtc/cam.html",
 	}, 200, map[string]any{
-		"Title": "Camera",
+		"Title":      "Camera",
+		"IceServers": WebrtcIceServers(сontroller.userId(request)),
 	})
 }
 
@@ -71,7 +75,11 @@ func (сontroller ControllerMain) CamStream(w http.ResponseWriter, r *http.Reque
 		"views/layouts/main.html",
 		"views/webrtc/cam.stream.html",
 	}, 200, map[string]any{
-		"Title": "Camera",
+		"Title":      "Camera",
+		"WsHost":     config.Env("HOST"),
+		"WsPort":     config.Env("WS_PORT"),
+		"WssPort":    config.Env("WSS_PORT"),
+		"IceServers": WebrtcIceServers(сontroller.userId(request)),
 	})
 }
 
@@ -87,7 +95,8 @@ func (сontroller ControllerMain) WebrtcChannelsIndex(w http.ResponseWriter, r *
 		"views/layouts/main.html",
 		"views/webrtc/channels.index.html",
 	}, 200, map[string]any{
-		"Title": "Data Channels",
+		"Title":      "Data Channels",
+		"IceServers": WebrtcIceServers(сontroller.userId(request)),
 	})
 }
 
@@ -110,6 +119,10 @@ func (сontroller ControllerMain) WebrtcSessionGet(w http.ResponseWriter, r *htt
 		wrObj.Data.Set("video", "storage/video/output.ivf")
 		wrObj.Data.Set("local_session", r.Form.Get("local_session"))
 
+		if r.Form.Get("trickle") == "true" || r.Form.Get("trickle") == "1" {
+			wrObj.Data.Set("trickle", true)
+		}
+
 		wrHub, err := WebrtHubByObj(wrObj)
 
 		if err != nil {
@@ -138,6 +151,10 @@ func (сontroller ControllerMain) WebrtcSessionGet(w http.ResponseWriter, r *htt
 						components.СonvertAssign(&remote_session, wrResp.Data.Get("remote_session"))
 
 						json.Set("remote_session", remote_session)
+						json.Set("session", wrResp.Data.Get("session"))
+						json.Set("token", wrResp.Data.Get("token"))
+						json.Set("trickle", wrResp.Data.Get("trickle"))
+						json.Set("ice_servers", WebrtcIceServers(сontroller.userId(request)))
 
 						payload, err := json.MarshalJSON()
 						if err != nil {
@@ -184,6 +201,11 @@ func (сontroller ControllerMain) WebrtcCameraSet(w http.ResponseWriter, r *http
 
 		wrObj.Data.Set("file_out", "tmp/webrtc/video.webm")
 		wrObj.Data.Set("local_session", r.Form.Get("local_session"))
+
+		if r.Form.Get("trickle") == "true" || r.Form.Get("trickle") == "1" {
+			wrObj.Data.Set("trickle", true)
+		}
+
 		wrObj.Data.Set("max_time", 60*10*time.Second)
 
 		wrHub, err := WebrtHubByObj(wrObj)
@@ -214,6 +236,10 @@ func (сontroller ControllerMain) WebrtcCameraSet(w http.ResponseWriter, r *http
 						components.СonvertAssign(&remote_session, wrResp.Data.Get("remote_session"))
 
 						json.Set("remote_session", remote_session)
+						json.Set("session", wrResp.Data.Get("session"))
+						json.Set("token", wrResp.Data.Get("token"))
+						json.Set("trickle", wrResp.Data.Get("trickle"))
+						json.Set("ice_servers", WebrtcIceServers(сontroller.userId(request)))
 
 						payload, err := json.MarshalJSON()
 						if err != nil {
@@ -244,6 +270,7 @@ func (сontroller ControllerMain) WebrtcCameraSet(w http.ResponseWriter, r *http
 	}
 }
 
+// WebrtcCameraStreamSet publishes the camera of the request in the room, the room is created if there is none.
 func (сontroller ControllerMain) WebrtcCameraStreamSet(w http.ResponseWriter, r *http.Request) {
 	request := controllers.NewRequest(w, r)
 	defer request.Store()
@@ -254,20 +281,89 @@ func (сontroller ControllerMain) WebrtcCameraStreamSet(w http.ResponseWriter, r
 
 	r.ParseForm()
 
-	if r.Form.Get("local_session") != "" {
-		wrObj := NewWebrtObj()
-		wrObj.Action = "cameraVideoStream"
+	if r.Form.Get("local_session") != "" && r.Form.Get("room") != "" {
+		room, err := webrtcPublishRoom(r.Form.Get("room"), сontroller.userId(request))
 
-		wrObj.Data.Set("key", CameraVideoStream)
-		wrObj.Data.Set("action.set", true)
-		wrObj.Data.Set("local_session", r.Form.Get("local_session"))
-		wrObj.Data.Set("max_time", 60*60*10*time.Second)
+		if err != nil {
+			сontroller.writeError(w, err)
+		} else {
+			сontroller.cameraStream(w, request, room, "action.set")
+		}
+	} else {
+		сontroller.writeError(w, fmt.Errorf("local_session or room not"))
+	}
+}
 
-		wrHub, err := WebrtHubByObj(wrObj)
+// WebrtcCameraStreamGet plays the publisher of the room, all the publishers when publisher is empty.
+func (сontroller ControllerMain) WebrtcCameraStreamGet(w http.ResponseWriter, r *http.Request) {
+	request := controllers.NewRequest(w, r)
+	defer request.Store()
 
-		if err != nil {
+	if !request.Valid {
+		return
+	}
+
+	r.ParseForm()
+
+	if r.Form.Get("local_session") != "" && r.Form.Get("room") != "" {
+		if room := WebrtcRoom(r.Form.Get("room")); room != nil {
+			сontroller.cameraStream(w, request, room, "action.get")
+		} else {
+			сontroller.writeError(w, fmt.Errorf("Room not found"))
+		}
+	} else {
+		сontroller.writeError(w, fmt.Errorf("local_session or room not"))
+	}
+}
+
+func (сontroller ControllerMain) cameraStream(w http.ResponseWriter, request *controllers.Request, room *webrtRoom, action string) {
+	r := request.Request
+
+	wrObj := NewWebrtObj()
+	wrObj.Action = "cameraVideoStream"
+
+	wrObj.Data.Set("key", room.WItem.Key)
+	wrObj.Data.Set("room", room.Name)
+	wrObj.Data.Set(action, true)
+	wrObj.Data.Set("publisher", r.Form.Get("publisher"))
+	wrObj.Data.Set("local_session", r.Form.Get("local_session"))
+
+	if r.Form.Get("trickle") == "true" || r.Form.Get("trickle") == "1" {
+		wrObj.Data.Set("trickle", true)
+	}
+
+	wrObj.Data.Set("ip", controllers.RequestIp(r))
+
+	if request.IsAuth() {
+		wrObj.Data.Set("user_id", uint64(request.User.Id.Get()))
+	}
+
+	room.WHub.ChanStack <- wrObj
+
+	select {
+	case wrResp, ok := <-wrObj.ChanSource:
+		if ok {
 			json := simplejson.New()
-			json.Set("error", fmt.Sprint(err))
+
+			switch wrResp.Action {
+			case "SessionDescription":
+				var remote_session string
+
+				components.СonvertAssign(&remote_session, wrResp.Data.Get("remote_session"))
+
+				json.Set("remote_session", remote_session)
+				json.Set("session", wrResp.Data.Get("session"))
+				json.Set("token", wrResp.Data.Get("token"))
+				json.Set("trickle", wrResp.Data.Get("trickle"))
+				json.Set("ice_servers", WebrtcIceServers(сontroller.userId(request)))
+				json.Set("room", wrResp.Data.Get("room"))
+
+				if wrResp.Data.Is("publisher") {
+					json.Set("publisher", wrResp.Data.Get("publisher"))
+				}
+			case "Error":
+				json.Set("error", wrResp.Data.Get("error"))
+			}
 
 			payload, err := json.MarshalJSON()
 			if err != nil {
@@ -277,51 +373,132 @@ func (сontroller ControllerMain) WebrtcCameraStreamSet(w http.ResponseWriter, r
 			w.Header().Set("Content-Type", "application/json")
 			w.Write(payload)
 		} else {
-			wrHub.ChanStack <- wrObj
+			fmt.Println("wrObj.ChanSource is close")
+		}
+	case <-time.After(10 * time.Second):
+		wrObj.CloseChanSource()
+	}
+}
 
-			select {
-			case wrResp, ok := <-wrObj.ChanSource:
-				if ok {
-					switch wrResp.Action {
-					case "SessionDescription":
-						json := simplejson.New()
+// WebrtcRooms lists the rooms of this node with their publishers.
+func (сontroller ControllerMain) WebrtcRooms(w http.ResponseWriter, r *http.Request) {
+	request := controllers.NewRequest(w, r)
+	defer request.Store()
 
-						var remote_session string
+	if !request.Valid {
+		return
+	}
 
-						components.СonvertAssign(&remote_session, wrResp.Data.Get("remote_session"))
+	payload, err := json.Marshal(WebrtcRooms())
+	if err != nil {
+		log.Println(err)
+		payload = []byte("[]")
+	}
 
-						json.Set("remote_session", remote_session)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
 
-						payload, err := json.MarshalJSON()
-						if err != nil {
-							log.Println(err)
-						}
+func (сontroller ControllerMain) WebrtcRoomCreate(w http.ResponseWriter, r *http.Request) {
+	request := controllers.NewRequest(w, r).Auth()
+	defer request.Store()
 
-						w.Header().Set("Content-Type", "application/json")
-						w.Write(payload)
-					}
-				} else {
-					fmt.Println("wrObj.ChanSource is close")
-				}
-			case <-time.After(10 * time.Second):
-				wrObj.CloseChanSource()
-			}
-		}
+	if !request.Valid {
+		return
+	}
+
+	r.ParseForm()
+
+	room, err := WebrtcRoomCreate(r.Form.Get("name"))
+
+	if err != nil {
+		сontroller.writeError(w, err)
+		return
+	}
+
+	payload, err := json.Marshal(room.info())
+	if err != nil {
+		log.Println(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
+
+func (сontroller ControllerMain) WebrtcRoomClose(w http.ResponseWriter, r *http.Request) {
+	request := controllers.NewRequest(w, r).Admin()
+	defer request.Store()
+
+	if !request.Valid {
+		return
+	}
+
+	r.ParseForm()
+
+	json := simplejson.New()
+
+	if r.Form.Get("name") != "" {
+		json.Set("ok", WebrtcRoomClose(r.Form.Get("name")))
 	} else {
-		json := simplejson.New()
-		json.Set("error", "local_session not")
+		json.Set("error", "name not")
+	}
 
-		payload, err := json.MarshalJSON()
-		if err != nil {
-			log.Println(err)
+	payload, err := json.MarshalJSON()
+	if err != nil {
+		log.Println(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
+
+// WebrtcCandidateAdd adds a candidate of the browser to the session of a trickle answer.
+func (сontroller ControllerMain) WebrtcCandidateAdd(w http.ResponseWriter, r *http.Request) {
+	request := controllers.NewRequest(w, r)
+	defer request.Store()
+
+	if !request.Valid {
+		return
+	}
+
+	r.ParseForm()
+
+	wrConn := webrtcConnection(r.Form.Get("session"))
+
+	if wrConn == nil || !wrConn.VerifyToken(r.Form.Get("token")) {
+		сontroller.writeError(w, fmt.Errorf("Session not found"))
+		return
+	}
+
+	candidate := webrtc.ICECandidateInit{}
+
+	if r.Form.Get("candidate") != "" {
+		if err := json.Unmarshal([]byte(r.Form.Get("candidate")), &candidate); err != nil {
+			сontroller.writeError(w, err)
+			return
 		}
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(payload)
+	if err := wrConn.AddCandidate(candidate); err != nil {
+		сontroller.writeError(w, err)
+		return
+	}
+
+	json := simplejson.New()
+	json.Set("ok", true)
+
+	payload, err := json.MarshalJSON()
+	if err != nil {
+		log.Println(err)
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
 }
 
-func (сontroller ControllerMain) WebrtcCameraStreamGet(w http.ResponseWriter, r *http.Request) {
+// WebrtcCandidateGet returns the candidates of the server gathered since the
+// last poll of the session, "complete" is the end of the gathering.
+func (сontroller ControllerMain) WebrtcCandidateGet(w http.ResponseWriter, r *http.Request) {
 	request := controllers.NewRequest(w, r)
 	defer request.Store()
 
@@ -331,83 +508,80 @@ func (сontroller ControllerMain) WebrtcCameraStreamGet(w http.ResponseWriter, r
 
 	r.ParseForm()
 
-	if r.Form.Get("local_session") != "" {
-		wrObj := NewWebrtObj()
-		wrObj.Action = "cameraVideoStream"
-
-		wrObj.Data.Set("key", CameraVideoStream)
-		wrObj.Data.Set("action.get", true)
-		wrObj.Data.Set("local_session", r.Form.Get("local_session"))
-		wrObj.Data.Set("max_time", 60*60*10*time.Second)
+	wrConn := webrtcConnection(r.Form.Get("session"))
 
-		wrHub, err := WebrtHubByObj(wrObj)
+	if wrConn == nil || !wrConn.VerifyToken(r.Form.Get("token")) {
+		сontroller.writeError(w, fmt.Errorf("Session not found"))
+		return
+	}
 
-		if err != nil {
-			json := simplejson.New()
-			json.Set("error", fmt.Sprint(err))
+	candidates, complete := wrConn.Candidates(WebrtcCandidateWait)
 
-			payload, err := json.MarshalJSON()
-			if err != nil {
-				log.Println(err)
-			}
+	payload, err := json.Marshal(map[string]any{
+		"candidates": candidates,
+		"complete":   complete,
+	})
+	if err != nil {
+		log.Println(err)
+	}
 
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(payload)
-		} else {
-			wrHub.ChanStack <- wrObj
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
 
-			select {
-			case wrResp, ok := <-wrObj.ChanSource:
-				if ok {
-					switch wrResp.Action {
-					case "SessionDescription":
-						json := simplejson.New()
+// WebrtcTurnCredentials issues time-limited credentials of the built-in TURN
+// server to the authorized user, with the ICE servers that use them.
+func (сontroller ControllerMain) WebrtcTurnCredentials(w http.ResponseWriter, r *http.Request) {
+	request := controllers.NewRequest(w, r).Auth()
+	defer request.Store()
 
-						var remote_session string
+	if !request.Valid {
+		return
+	}
 
-						components.СonvertAssign(&remote_session, wrResp.Data.Get("remote_session"))
+	userId := сontroller.userId(request)
 
-						json.Set("remote_session", remote_session)
+	username, credential, err := WebrtcTurnCredentials(userId)
+	if err != nil {
+		сontroller.writeError(w, err)
+		return
+	}
 
-						payload, err := json.MarshalJSON()
-						if err != nil {
-							log.Println(err)
-						}
+	json := simplejson.New()
+	json.Set("username", username)
+	json.Set("credential", credential)
+	json.Set("ttl", int(config.TurnCredentialTtl.Seconds()))
+	json.Set("ice_servers", WebrtcIceServers(userId))
 
-						w.Header().Set("Content-Type", "application/json")
-						w.Write(payload)
-					case "Error":
-						json := simplejson.New()
+	payload, err := json.MarshalJSON()
+	if err != nil {
+		log.Println(err)
+	}
 
-						json.Set("error", wrResp.Data.Get("error"))
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
 
-						payload, err := json.MarshalJSON()
-						if err != nil {
-							log.Println(err)
-						}
+func (сontroller ControllerMain) userId(request *controllers.Request) uint64 {
+	if request.IsAuth() {
+		return uint64(request.User.Id.Get())
+	}
 
-						w.Header().Set("Content-Type", "application/json")
-						w.Write(payload)
-					}
-				} else {
-					fmt.Println("wrObj.ChanSource is close")
-				}
-			case <-time.After(10 * time.Second):
-				wrObj.CloseChanSource()
-			}
-		}
-	} else {
-		json := simplejson.New()
-		json.Set("error", "local_session not")
+	return 0
+}
 
-		payload, err := json.MarshalJSON()
-		if err != nil {
-			log.Println(err)
-		}
+func (сontroller ControllerMain) writeError(w http.ResponseWriter, err error) {
+	json := simplejson.New()
+	json.Set("error", fmt.Sprint(err))
 
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(payload)
+	payload, err := json.MarshalJSON()
+	if err != nil {
+		log.Println(err)
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
 }
 
 func (сontroller ControllerMain) WebrtcChannelsSessionGet(w http.ResponseWriter, r *http.Request) {
@@ -426,6 +600,16 @@ func (сontroller ControllerMain) WebrtcChannelsSessionGet(w http.ResponseWriter
 
 		wrObj.Data.Set("local_session", r.Form.Get("local_session"))
 
+		if r.Form.Get("trickle") == "true" || r.Form.Get("trickle") == "1" {
+			wrObj.Data.Set("trickle", true)
+		}
+
+		wrObj.Data.Set("ip", controllers.RequestIp(r))
+
+		if request.IsAuth() {
+			wrObj.Data.Set("user_id", uint64(request.User.Id.Get()))
+		}
+
 		wrHub, err := WebrtHubByObj(wrObj)
 
 		if err != nil {
@@ -454,6 +638,10 @@ func (сontroller ControllerMain) WebrtcChannelsSessionGet(w http.ResponseWriter
 						components.СonvertAssign(&remote_session, wrResp.Data.Get("remote_session"))
 
 						json.Set("remote_session", remote_session)
+						json.Set("session", wrResp.Data.Get("session"))
+						json.Set("token", wrResp.Data.Get("token"))
+						json.Set("trickle", wrResp.Data.Get("trickle"))
+						json.Set("ice_servers", WebrtcIceServers(сontroller.userId(request)))
 
 						payload, err := json.MarshalJSON()
 						if err != nil {
@@ -1,14 +1,20 @@
 package webrtc
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
 	"crypto/tls"
+	"encoding/base64"
+	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
 	"regexp"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/pion/turn/v2"
 )
@@ -24,10 +30,14 @@ type TurnServer struct {
 	KeyFile  string
 	UsersMap map[string][]byte
 
+	// Shared secret of the time-limited credentials of the TURN REST API,
+	// empty for the static Users only
+	Secret string
+
 	Turn *turn.Server
 }
 
-func NewTurnServer(ip string, portUdp int, portTcp int, portTls int, users string, realm string, certFile string, keyFile string) *TurnServer {
+func NewTurnServer(ip string, portUdp int, portTcp int, portTls int, users string, realm string, certFile string, keyFile string, secret string) *TurnServer {
 	return &TurnServer{
 		IP:       ip,
 		PortUdp:  portUdp,
@@ -38,9 +48,80 @@ func NewTurnServer(ip string, portUdp int, portTcp int, portTls int, users strin
 		CertFile: certFile,
 		KeyFile:  keyFile,
 		UsersMap: map[string][]byte{},
+		Secret:   secret,
 	}
 }
 
+// IceServers are the urls of the listeners of the server with the credentials.
+func (ts *TurnServer) IceServers(username string, credential string) []WebrtcIceServer {
+	urls := []string{}
+
+	if ts.PortUdp > 0 {
+		urls = append(urls, fmt.Sprintf("turn:%s:%d?transport=udp", ts.IP, ts.PortUdp))
+	}
+
+	if ts.PortTcp > 0 {
+		urls = append(urls, fmt.Sprintf("turn:%s:%d?transport=tcp", ts.IP, ts.PortTcp))
+	}
+
+	if ts.PortTls > 0 && len(ts.CertFile) > 0 && len(ts.KeyFile) > 0 {
+		urls = append(urls, fmt.Sprintf("turns:%s:%d?transport=tcp", ts.IP, ts.PortTls))
+	}
+
+	if len(ts.IP) == 0 || len(urls) == 0 {
+		return nil
+	}
+
+	return []WebrtcIceServer{
+		{
+			URLs:       urls,
+			Username:   username,
+			Credential: credential,
+		},
+	}
+}
+
+// User returns the first of the static Users.
+func (ts *TurnServer) User() (string, string) {
+	if kv := regexp.MustCompile(`(\w+)=(\w+)`).FindStringSubmatch(ts.Users); kv != nil {
+		return kv[1], kv[2]
+	}
+
+	return "", ""
+}
+
+// Credentials issues the time-limited credentials of the user: the username is
+// <expires>:<user id> and the password the base64 HMAC-SHA1 of it with Secret.
+func (ts *TurnServer) Credentials(userId uint64, ttl time.Duration) (string, string) {
+	username := fmt.Sprintf("%d:%d", time.Now().Add(ttl).Unix(), userId)
+
+	return username, ts.credential(username)
+}
+
+func (ts *TurnServer) credential(username string) string {
+	mac := hmac.New(sha1.New, []byte(ts.Secret))
+	mac.Write([]byte(username))
+
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// AuthHandler returns the key of a static user or of unexpired credentials of Secret.
+func (ts *TurnServer) AuthHandler(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
+	if key, ok := ts.UsersMap[username]; ok {
+		return key, true
+	}
+
+	if len(ts.Secret) > 0 {
+		if splitUsername := strings.SplitN(username, ":", 2); len(splitUsername) == 2 {
+			if expires, err := strconv.ParseInt(splitUsername[0], 10, 64); err == nil && time.Now().Unix() < expires {
+				return turn.GenerateAuthKey(username, ts.Realm, ts.credential(username)), true
+			}
+		}
+	}
+
+	return nil, false
+}
+
 func (ts *TurnServer) Run() {
 	if len(ts.IP) == 0 {
 		log.Println("'public-ip' is required")
@@ -131,16 +212,13 @@ func (ts *TurnServer) Run() {
 		for _, kv := range regexp.MustCompile(`(\w+)=(\w+)`).FindAllStringSubmatch(ts.Users, -1) {
 			ts.UsersMap[kv[1]] = turn.GenerateAuthKey(kv[1], ts.Realm, kv[2])
 		}
+	}
 
+	if len(ts.UsersMap) > 0 || len(ts.Secret) > 0 {
 		// Set AuthHandler callback
 		// This is called every time a user tries to authenticate with the TURN server
 		// Return the key for that user, or false when no user is found
-		turnServerConfig.AuthHandler = func(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
-			if key, ok := ts.UsersMap[username]; ok {
-				return key, true
-			}
-			return nil, false
-		}
+		turnServerConfig.AuthHandler = ts.AuthHandler
 	} else {
 		//log.Println("'users' is required")
 		//return
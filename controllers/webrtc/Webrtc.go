@@ -2,6 +2,7 @@ package webrtc
 
 import (
 	"backnet/components"
+	"backnet/controllers"
 	"context"
 	"errors"
 	"fmt"
@@ -26,6 +27,7 @@ import (
 	"backnet/config"
 
 	"github.com/at-wat/ebml-go/webm"
+	"github.com/bitly/go-simplejson"
 )
 
 type webrtResp struct {
@@ -45,9 +47,31 @@ type webrtObj struct {
 type webrtConnection struct {
 	Mutex       sync.Mutex
 	KeyI        uint64
+	UserId      uint64
+	Ip          string
+	ConnectAt   time.Time
+	Time        int64
 	WItem       *webrtItem
 	Connection  *webrtc.PeerConnection
 	DataChannel *webrtc.DataChannel
+
+	// Trickle ICE: the token of the session and the local candidates not polled yet
+	Token         string
+	candidates    []webrtc.ICECandidateInit
+	gathered      bool
+	candidateChan chan struct{}
+
+	// The websocket client of the signaling, nil for the sessions of the POST routes.
+	// The candidates are sent in order under signalMutex, out of the Mutex
+	Signal      *controllers.WebsocketClient
+	signaled    bool
+	signalMutex sync.Mutex
+
+	// The descriptions are set under offerMutex, an offer of the server is
+	// not locked while it waits for the answer
+	offerMutex sync.Mutex
+	offering   bool
+	offerAgain bool
 }
 
 type webrtItem struct {
@@ -58,6 +82,9 @@ type webrtItem struct {
 	OfferChan    chan *webrtObj
 	CompleteChan chan error
 	Connections  map[uint64]*webrtConnection
+
+	// The room of the item, nil for the other actions
+	Room *webrtRoom
 }
 
 type webrtHub struct {
@@ -67,6 +94,7 @@ type webrtHub struct {
 	Key       uint64
 	Conn_i    uint64
 	Stack     map[uint64]*webrtItem
+	Rooms     map[string]*webrtRoom
 }
 
 type WebrtcApi struct {
@@ -78,6 +106,10 @@ type WebrtcApi struct {
 
 var webrtcApp WebrtcApi
 
+// The handler of the data channels, registered by WebrtcHandle
+var dataChannelHandler controllers.ConnectionHandler
+var dataChannelMutex sync.RWMutex
+
 type webmSaver struct {
 	audioWriter, videoWriter       webm.BlockWriteCloser
 	audioBuilder, videoBuilder     *samplebuilder.SampleBuilder
@@ -91,17 +123,32 @@ func newWebmSaver() *webmSaver {
 	}
 }
 
-func (wItem *webrtItem) NewWebrtConnection(peerConnection *webrtc.PeerConnection) *webrtConnection {
-	atomic.AddUint64(&wItem.WHub.Conn_i, 1)
-	conn_i := wItem.WHub.Conn_i
+// NewWebrtConnection adds the connection of the request WObj to the item.
+// The Connections are only read and written under the Mutex of the item.
+func (wItem *webrtItem) NewWebrtConnection(peerConnection *webrtc.PeerConnection, WObj *webrtObj) *webrtConnection {
+	conn_i := atomic.AddUint64(&wItem.WHub.Conn_i, 1)
 
-	wItem.Connections[conn_i] = &webrtConnection{
+	wrConn := &webrtConnection{
 		KeyI:       conn_i,
 		Connection: peerConnection,
 		WItem:      wItem,
+		ConnectAt:  time.Now(),
+		Time:       time.Now().Unix(),
 	}
 
-	return wItem.Connections[conn_i]
+	if WObj.Data.Is("user_id") {
+		components.СonvertAssign(&wrConn.UserId, WObj.Data.Get("user_id"))
+	}
+
+	if WObj.Data.Is("ip") {
+		components.СonvertAssign(&wrConn.Ip, WObj.Data.Get("ip"))
+	}
+
+	wItem.Mutex.Lock()
+	wItem.Connections[conn_i] = wrConn
+	wItem.Mutex.Unlock()
+
+	return wrConn
 }
 
 func (s *webmSaver) Close() {
@@ -248,6 +295,9 @@ func (wrHub *webrtHub) isWebrtItemByObj(wrObj *webrtObj) bool {
 	var key uint64
 	components.СonvertAssign(&key, wrObj.Data.Get("key"))
 
+	wrHub.Mutex.Lock()
+	defer wrHub.Mutex.Unlock()
+
 	if _, ok := wrHub.Stack[key]; ok {
 		return true
 	}
@@ -259,8 +309,12 @@ func (wrHub *webrtHub) webrtItemByObj(wrObj *webrtObj) *webrtItem {
 	var key uint64
 	components.СonvertAssign(&key, wrObj.Data.Get("key"))
 
-	if _, ok := wrHub.Stack[key]; ok {
-		return wrHub.Stack[key]
+	wrHub.Mutex.Lock()
+
+	if wItem, ok := wrHub.Stack[key]; ok {
+		wrHub.Mutex.Unlock()
+
+		return wItem
 	}
 
 	wItem := &webrtItem{
@@ -273,18 +327,66 @@ func (wrHub *webrtHub) webrtItemByObj(wrObj *webrtObj) *webrtItem {
 	}
 
 	wrHub.Stack[key] = wItem
+	wrHub.Mutex.Unlock()
 
 	wItem.run()
 
 	return wItem
 }
 
+// item returns the item with the key, nil if there is none.
+func (wrHub *webrtHub) item(key uint64) *webrtItem {
+	wrHub.Mutex.Lock()
+	defer wrHub.Mutex.Unlock()
+
+	return wrHub.Stack[key]
+}
+
+// items returns the items of the hub, the Stack is only read under the Mutex.
+func (wrHub *webrtHub) items() []*webrtItem {
+	wrHub.Mutex.Lock()
+	defer wrHub.Mutex.Unlock()
+
+	wItems := make([]*webrtItem, 0, len(wrHub.Stack))
+
+	for _, wItem := range wrHub.Stack {
+		wItems = append(wItems, wItem)
+	}
+
+	return wItems
+}
+
+// conn returns the connection with the key, nil if there is none.
+func (wItem *webrtItem) conn(conn_i uint64) *webrtConnection {
+	wItem.Mutex.Lock()
+	defer wItem.Mutex.Unlock()
+
+	return wItem.Connections[conn_i]
+}
+
+// conns returns the connections of the item.
+func (wItem *webrtItem) conns() []*webrtConnection {
+	wItem.Mutex.Lock()
+	defer wItem.Mutex.Unlock()
+
+	wrConns := make([]*webrtConnection, 0, len(wItem.Connections))
+
+	for _, wrConn := range wItem.Connections {
+		wrConns = append(wrConns, wrConn)
+	}
+
+	return wrConns
+}
+
 func (wItem *webrtItem) delConn(conn_i uint64) {
-	if _, ok := wItem.Connections[conn_i]; ok {
-		wItem.Connections[conn_i].Connection.Close()
-		wItem.Mutex.Lock()
-		delete(wItem.Connections, conn_i)
-		wItem.Mutex.Unlock()
+	wItem.Mutex.Lock()
+	wrConn, ok := wItem.Connections[conn_i]
+	delete(wItem.Connections, conn_i)
+	wItem.Mutex.Unlock()
+
+	if ok {
+		wrConn.Connection.Close()
+		wrConn.signalHangup()
 	}
 }
 
@@ -296,27 +398,14 @@ func (wItem *webrtItem) runPeer(traks map[string]webrtc.TrackLocal, cb_connect f
 			case WObj := <-wItem.OfferChan:
 				fmt.Println("runPeer OfferChan")
 
-				offer := webrtc.SessionDescription{}
-				var local_session string
-
-				components.СonvertAssign(&local_session, WObj.Data.Get("local_session"))
-
-				components.Decode(local_session, &offer)
-
 				// Create a new PeerConnection
-				peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{
-					ICEServers: []webrtc.ICEServer{
-						{
-							URLs: []string{"stun:stun.l.google.com:19302"},
-						},
-					},
-				})
+				peerConnection, err := webrtc.NewPeerConnection(webrtcConfiguration())
 				if err != nil {
 					WObj.CloseChanSource()
 					continue
 				}
 
-				webrtConnection := wItem.NewWebrtConnection(peerConnection)
+				webrtConnection := wItem.NewWebrtConnection(peerConnection, WObj)
 
 				isCbConnect := true
 				isCbClose := true
@@ -339,7 +428,7 @@ func (wItem *webrtItem) runPeer(traks map[string]webrtc.TrackLocal, cb_connect f
 					fmt.Printf("Peer Connection State has changed: %s\n", s.String())
 
 					if s == webrtc.PeerConnectionStateDisconnected || s == webrtc.PeerConnectionStateFailed || s == webrtc.PeerConnectionStateFailed {
-						if _, ok := wItem.Connections[webrtConnection.KeyI]; ok {
+						if wItem.conn(webrtConnection.KeyI) != nil {
 							if isCbClose {
 								isCbClose = false
 								WObj.CloseChanSource()
@@ -365,50 +454,12 @@ func (wItem *webrtItem) runPeer(traks map[string]webrtc.TrackLocal, cb_connect f
 					}
 				}
 
-				// Set the remote SessionDescription
-				err = webrtConnection.Connection.SetRemoteDescription(offer)
-				if err != nil {
+				if err := webrtConnection.answer(WObj, nil); err != nil {
+					fmt.Println(err)
 					WObj.CloseChanSource()
 					wItem.delConn(webrtConnection.KeyI)
 					continue
 				}
-
-				// Create answer
-				answer, err := webrtConnection.Connection.CreateAnswer(nil)
-				if err != nil {
-					WObj.CloseChanSource()
-					wItem.delConn(webrtConnection.KeyI)
-					continue
-				}
-
-				// Sets the LocalDescription, and starts our UDP listeners
-				err = webrtConnection.Connection.SetLocalDescription(answer)
-				if err != nil {
-					WObj.CloseChanSource()
-					wItem.delConn(webrtConnection.KeyI)
-					continue
-				}
-
-				webrtConnection.Connection.OnICECandidate(func(c *webrtc.ICECandidate) {
-					if c == nil {
-						return
-					}
-
-					if WObj.OpenChanSource {
-						if _, ok := wItem.Connections[webrtConnection.KeyI]; ok {
-							wResp := &webrtResp{
-								Action: "SessionDescription",
-								Data:   components.NewData(),
-							}
-
-							wResp.Data.Set("remote_session", components.Encode(*webrtConnection.Connection.LocalDescription()))
-
-							WObj.SendChanSource(wResp)
-
-							WObj.CloseChanSource()
-						}
-					}
-				})
 			case <-wItem.CompleteChan:
 				return
 			}
@@ -433,8 +484,8 @@ func (wItem *webrtItem) complete() {
 	}
 	wItem.WHub.Mutex.Unlock()
 
-	for i, _ := range wItem.Connections {
-		wItem.delConn(i)
+	for _, wrConn := range wItem.conns() {
+		wItem.delConn(wrConn.KeyI)
 	}
 }
 
@@ -474,18 +525,12 @@ func (wItem *webrtItem) run() {
 			api := webrtc.NewAPI(webrtc.WithMediaEngine(m))
 
 			// Create a new RTCPeerConnection
-			peerConnection, err := api.NewPeerConnection(webrtc.Configuration{
-				ICEServers: []webrtc.ICEServer{
-					{
-						URLs: []string{"stun:stun.l.google.com:19302"},
-					},
-				},
-			})
+			peerConnection, err := api.NewPeerConnection(webrtcConfiguration())
 			if err != nil {
 				return
 			}
 
-			webrtConnection := wItem.NewWebrtConnection(peerConnection)
+			webrtConnection := wItem.NewWebrtConnection(peerConnection, wItem.WObj)
 
 			// Set a handler for when a new remote track starts, this handler copies inbound RTP packets,
 			// replaces the SSRC and sends them back
@@ -494,7 +539,7 @@ func (wItem *webrtItem) run() {
 				go func() {
 					ticker := time.NewTicker(time.Second * 3)
 					for range ticker.C {
-						if _, ok := wItem.Connections[webrtConnection.KeyI]; ok {
+						if wItem.conn(webrtConnection.KeyI) != nil {
 							errSend := webrtConnection.Connection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
 							if errSend != nil {
 								fmt.Println(errSend)
@@ -533,7 +578,7 @@ func (wItem *webrtItem) run() {
 				fmt.Printf("Peer Connection State has changed: %s\n", s.String())
 
 				if s == webrtc.PeerConnectionStateDisconnected || s == webrtc.PeerConnectionStateFailed || s == webrtc.PeerConnectionStateFailed {
-					if _, ok := wItem.Connections[webrtConnection.KeyI]; ok {
+					if wItem.conn(webrtConnection.KeyI) != nil {
 						wItem.WObj.CloseChanSource()
 						wItem.delConn(webrtConnection.KeyI)
 						iceConnectedCtxCancel()
@@ -542,51 +587,12 @@ func (wItem *webrtItem) run() {
 				}
 			})
 
-			offer := webrtc.SessionDescription{}
-			var local_session string
-
-			components.СonvertAssign(&local_session, wItem.WObj.Data.Get("local_session"))
-
-			components.Decode(local_session, &offer)
-			// Set the remote SessionDescription
-			err = webrtConnection.Connection.SetRemoteDescription(offer)
-			if err != nil {
-				return
-			}
-
-			// Create an answer
-			answer, err := webrtConnection.Connection.CreateAnswer(nil)
-			if err != nil {
-				return
-			}
-
-			// Sets the LocalDescription, and starts our UDP listeners
-			err = webrtConnection.Connection.SetLocalDescription(answer)
-			if err != nil {
+			if err := webrtConnection.answer(wItem.WObj, nil); err != nil {
+				fmt.Println(err)
+				wItem.WObj.CloseChanSource()
 				return
 			}
 
-			webrtConnection.Connection.OnICECandidate(func(c *webrtc.ICECandidate) {
-				if c == nil {
-					return
-				}
-
-				if wItem.WObj.OpenChanSource {
-					if _, ok := wItem.Connections[webrtConnection.KeyI]; ok {
-						wResp := &webrtResp{
-							Action: "SessionDescription",
-							Data:   components.NewData(),
-						}
-
-						wResp.Data.Set("remote_session", components.Encode(*webrtConnection.Connection.LocalDescription()))
-
-						wItem.WObj.SendChanSource(wResp)
-
-						wItem.WObj.CloseChanSource()
-					}
-				}
-			})
-
 			var max_time time.Duration
 
 			if wItem.WObj.Data.Is("max_time") {
@@ -601,7 +607,7 @@ func (wItem *webrtItem) run() {
 			}
 
 			saver.Close()
-			if _, ok := wItem.Connections[webrtConnection.KeyI]; ok {
+			if wItem.conn(webrtConnection.KeyI) != nil {
 				webrtConnection.Connection.Close()
 				wItem.WObj.CloseChanSource()
 			}
@@ -761,175 +767,6 @@ func (wItem *webrtItem) run() {
 				iceConnectedCtxCancel()
 			}, func() {})
 		}()
-	case "cameraVideoStream":
-		go func() {
-			wItem.start()
-			defer wItem.complete()
-
-			traks := map[string]webrtc.TrackLocal{}
-
-			iceConnectedCtx, iceConnectedCtxCancel := context.WithCancel(context.Background())
-			startConnectedCtx, startConnectedCtxCancel := context.WithCancel(context.Background())
-
-			// Create a new RTCPeerConnection
-			peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{
-				ICEServers: []webrtc.ICEServer{
-					{
-						URLs: []string{"stun:stun.l.google.com:19302"},
-					},
-				},
-			})
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-
-			webrtConnection := wItem.NewWebrtConnection(peerConnection)
-
-			// Set a handler for when a new remote track starts, this handler copies inbound RTP packets,
-			// replaces the SSRC and sends them back
-			webrtConnection.Connection.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-				// Send a PLI on an interval so that the publisher is pushing a keyframe every rtcpPLIInterval
-				// This can be less wasteful by processing incoming RTCP events, then we would emit a NACK/PLI when a viewer requests it
-				go func() {
-					ticker := time.NewTicker(time.Second * 3)
-					for range ticker.C {
-						if _, ok := wItem.Connections[webrtConnection.KeyI]; ok {
-							if rtcpSendErr := webrtConnection.Connection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(remoteTrack.SSRC())}}); rtcpSendErr != nil {
-								fmt.Println(rtcpSendErr)
-							}
-						} else {
-							return
-						}
-					}
-				}()
-
-				fmt.Printf("Track has started, of type %d: %s \n", remoteTrack.PayloadType(), remoteTrack.Codec().RTPCodecCapability.MimeType)
-
-				// Create a local track, all our SFU clients will be fed via this track
-				localTrack, newTrackErr := webrtc.NewTrackLocalStaticRTP(remoteTrack.Codec().RTPCodecCapability, remoteTrack.Codec().RTPCodecCapability.MimeType, "pion")
-				if newTrackErr != nil {
-					fmt.Println(newTrackErr)
-					return
-				}
-
-				traks[remoteTrack.Codec().RTPCodecCapability.MimeType] = localTrack
-
-				if len(traks) == 1 {
-					startConnectedCtxCancel()
-				}
-
-				rtpBuf := make([]byte, 1400)
-				for {
-					i, _, readErr := remoteTrack.Read(rtpBuf)
-					if readErr != nil {
-						fmt.Println(readErr)
-						return
-					}
-
-					// ErrClosedPipe means we don't have any subscribers, this is ok if no peers have connected yet
-					if _, err = localTrack.Write(rtpBuf[:i]); err != nil && !errors.Is(err, io.ErrClosedPipe) {
-						fmt.Println(err)
-						return
-					}
-				}
-			})
-			// Set the handler for ICE connection state
-			// This will notify you when the peer has connected/disconnected
-			webrtConnection.Connection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-				fmt.Printf("Connection State has changed %s \n", connectionState.String())
-			})
-
-			webrtConnection.Connection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-				fmt.Printf("Peer Connection State has changed: %s\n", s.String())
-
-				if s == webrtc.PeerConnectionStateDisconnected || s == webrtc.PeerConnectionStateFailed || s == webrtc.PeerConnectionStateFailed {
-					if _, ok := wItem.Connections[webrtConnection.KeyI]; ok {
-						wItem.WObj.CloseChanSource()
-						wItem.delConn(webrtConnection.KeyI)
-						iceConnectedCtxCancel()
-						return
-					}
-				}
-			})
-
-			offer := webrtc.SessionDescription{}
-			var local_session string
-
-			components.СonvertAssign(&local_session, wItem.WObj.Data.Get("local_session"))
-
-			components.Decode(local_session, &offer)
-			// Set the remote SessionDescription
-			err = webrtConnection.Connection.SetRemoteDescription(offer)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-
-			// Create an answer
-			answer, err := webrtConnection.Connection.CreateAnswer(nil)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-
-			// Sets the LocalDescription, and starts our UDP listeners
-			err = webrtConnection.Connection.SetLocalDescription(answer)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-
-			webrtConnection.Connection.OnICECandidate(func(c *webrtc.ICECandidate) {
-				if c == nil {
-					return
-				}
-
-				if wItem.WObj.OpenChanSource {
-					if _, ok := wItem.Connections[webrtConnection.KeyI]; ok {
-						wResp := &webrtResp{
-							Action: "SessionDescription",
-							Data:   components.NewData(),
-						}
-
-						wResp.Data.Set("remote_session", components.Encode(*webrtConnection.Connection.LocalDescription()))
-
-						wItem.WObj.SendChanSource(wResp)
-
-						wItem.WObj.CloseChanSource()
-					}
-				}
-			})
-
-			var max_time time.Duration
-
-			if wItem.WObj.Data.Is("max_time") {
-				components.СonvertAssign(&max_time, wItem.WObj.Data.Get("max_time"))
-			} else {
-				max_time = 60 * 60 * time.Second
-			}
-
-			<-startConnectedCtx.Done()
-
-			go func() {
-				wItem.runPeer(traks, func() {
-				}, func() {
-					iceConnectedCtxCancel()
-				})
-			}()
-
-			select {
-			case <-iceConnectedCtx.Done():
-			case <-time.After(max_time):
-			}
-
-			if _, ok := wItem.Connections[webrtConnection.KeyI]; ok {
-				webrtConnection.Connection.Close()
-				wItem.WObj.CloseChanSource()
-			}
-
-			fmt.Println("Track has stoped")
-		}()
 	case "WebrtcChannelsSessionGet":
 		go func() {
 			wItem.start()
@@ -938,21 +775,15 @@ func (wItem *webrtItem) run() {
 			iceConnectedCtx, iceConnectedCtxCancel := context.WithCancel(context.Background())
 
 			// Create a new RTCPeerConnection
-			peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{
-				ICEServers: []webrtc.ICEServer{
-					{
-						URLs: []string{"stun:stun.l.google.com:19302"},
-					},
-				},
-			})
+			peerConnection, err := webrtc.NewPeerConnection(webrtcConfiguration())
 			if err != nil {
 				fmt.Println(err)
 				return
 			}
 
-			webrtConnection := wItem.NewWebrtConnection(peerConnection)
+			webrtConnection := wItem.NewWebrtConnection(peerConnection, wItem.WObj)
 
-			dc := NewControllerDataChannel()
+			dc := webrtcHandler()
 
 			// Set a handler for when a new remote track starts, this handler copies inbound RTP packets,
 			// replaces the SSRC and sends them back
@@ -963,16 +794,28 @@ func (wItem *webrtItem) run() {
 
 				// Register channel opening handling
 				d.OnOpen(func() {
-					dc.OnConnect(webrtConnection)
+					controllers.PresenceConnect(webrtConnection.UserId, controllers.PresenceTransportWebrtc, webrtConnection.Key())
+
+					if dc != nil {
+						dc.OnConnect(webrtConnection)
+					}
 				})
 
 				// Register text message handling
 				d.OnMessage(func(msg webrtc.DataChannelMessage) {
-					dc.OnMessage(webrtConnection, msg.Data)
+					atomic.StoreInt64(&webrtConnection.Time, time.Now().Unix())
+
+					if dc != nil {
+						dc.OnMessage(webrtConnection, msg.Data)
+					}
 				})
 
 				d.OnClose(func() {
-					dc.OnClose(webrtConnection)
+					controllers.PresenceDisconnect(webrtConnection.UserId, controllers.PresenceTransportWebrtc, webrtConnection.Key())
+
+					if dc != nil {
+						dc.OnClose(webrtConnection)
+					}
 				})
 			})
 
@@ -986,7 +829,7 @@ func (wItem *webrtItem) run() {
 				fmt.Printf("Peer Connection State has changed: %s\n", s.String())
 
 				if s == webrtc.PeerConnectionStateDisconnected || s == webrtc.PeerConnectionStateFailed || s == webrtc.PeerConnectionStateFailed {
-					if _, ok := wItem.Connections[webrtConnection.KeyI]; ok {
+					if wItem.conn(webrtConnection.KeyI) != nil {
 						wItem.WObj.CloseChanSource()
 						wItem.delConn(webrtConnection.KeyI)
 						iceConnectedCtxCancel()
@@ -995,54 +838,12 @@ func (wItem *webrtItem) run() {
 				}
 			})
 
-			offer := webrtc.SessionDescription{}
-			var local_session string
-
-			components.СonvertAssign(&local_session, wItem.WObj.Data.Get("local_session"))
-
-			components.Decode(local_session, &offer)
-			// Set the remote SessionDescription
-			err = webrtConnection.Connection.SetRemoteDescription(offer)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-
-			// Create an answer
-			answer, err := webrtConnection.Connection.CreateAnswer(nil)
-			if err != nil {
-				fmt.Println(err)
-				return
-			}
-
-			// Sets the LocalDescription, and starts our UDP listeners
-			err = webrtConnection.Connection.SetLocalDescription(answer)
-			if err != nil {
+			if err := webrtConnection.answer(wItem.WObj, nil); err != nil {
 				fmt.Println(err)
+				wItem.WObj.CloseChanSource()
 				return
 			}
 
-			webrtConnection.Connection.OnICECandidate(func(c *webrtc.ICECandidate) {
-				if c == nil {
-					return
-				}
-
-				if wItem.WObj.OpenChanSource {
-					if _, ok := wItem.Connections[webrtConnection.KeyI]; ok {
-						wResp := &webrtResp{
-							Action: "SessionDescription",
-							Data:   components.NewData(),
-						}
-
-						wResp.Data.Set("remote_session", components.Encode(*webrtConnection.Connection.LocalDescription()))
-
-						wItem.WObj.SendChanSource(wResp)
-
-						wItem.WObj.CloseChanSource()
-					}
-				}
-			})
-
 			<-iceConnectedCtx.Done()
 		}()
 	default:
@@ -1059,6 +860,7 @@ func (wr *WebrtcApi) neWHub() {
 		ChanStack: make(chan *webrtObj),
 		Conn_i:    0,
 		Stack:     map[uint64]*webrtItem{},
+		Rooms:     map[string]*webrtRoom{},
 	}
 
 	go wr.Stack[key].RunHub()
@@ -1072,24 +874,31 @@ func (wrHub *webrtHub) RunHub() {
 			case "cameraVideoSave":
 				wrHub.webrtItemByObj(WObj)
 			case "cameraVideoStream":
-				if WObj.Data.Is("action.get") {
-					if wrHub.isWebrtItemByObj(WObj) {
-						wItem := wrHub.webrtItemByObj(WObj)
-						wItem.OfferChan <- WObj
-					} else {
-						wResp := &webrtResp{
-							Action: "Error",
-							Data:   components.NewData(),
-						}
+				var name string
 
-						wResp.Data.Set("error", "Camera no set")
+				components.СonvertAssign(&name, WObj.Data.Get("room"))
 
-						WObj.SendChanSource(wResp)
+				wrHub.Mutex.Lock()
+				room, ok := wrHub.Rooms[name]
+				wrHub.Mutex.Unlock()
 
-						WObj.CloseChanSource()
+				if ok {
+					if WObj.Data.Is("action.get") {
+						go room.subscribe(WObj)
+					} else {
+						go room.publish(WObj)
 					}
 				} else {
-					wrHub.webrtItemByObj(WObj)
+					wResp := &webrtResp{
+						Action: "Error",
+						Data:   components.NewData(),
+					}
+
+					wResp.Data.Set("error", "Room not found")
+
+					WObj.SendChanSource(wResp)
+
+					WObj.CloseChanSource()
 				}
 			case "WebrtcChannelsSessionGet":
 				wrHub.webrtItemByObj(WObj)
@@ -1110,6 +919,21 @@ func Webrtc() (*WebrtcApi, error) {
 	return nil, fmt.Errorf("Webrtc connection is prohibited on this server")
 }
 
+// WebrtcHandle serves the data channels with the handler of all transports.
+func WebrtcHandle(handler controllers.ConnectionHandler) {
+	dataChannelMutex.Lock()
+	defer dataChannelMutex.Unlock()
+
+	dataChannelHandler = handler
+}
+
+func webrtcHandler() controllers.ConnectionHandler {
+	dataChannelMutex.RLock()
+	defer dataChannelMutex.RUnlock()
+
+	return dataChannelHandler
+}
+
 func WebrtHub() (*webrtHub, error) {
 	wr, err := Webrtc()
 
@@ -1118,15 +942,16 @@ func WebrtHub() (*webrtHub, error) {
 	}
 
 	var hub *webrtHub
+	var count uint64
 
 	for i, _ := range wr.Stack {
-		hub = wr.Stack[i]
-		break
-	}
+		wr.Stack[i].Mutex.Lock()
+		hubCount := wr.Stack[i].Count
+		wr.Stack[i].Mutex.Unlock()
 
-	for i, _ := range wr.Stack {
-		if wr.Stack[i].Count < hub.Count {
+		if hub == nil || hubCount < count {
 			hub = wr.Stack[i]
+			count = hubCount
 		}
 	}
 
@@ -1146,10 +971,12 @@ func WebrtHubByObj(wrObj *webrtObj) (*webrtHub, error) {
 
 	if key > 0 {
 		for i, _ := range wr.Stack {
-			for j, _ := range wr.Stack[i].Stack {
-				if j == key {
-					return wr.Stack[i], nil
-				}
+			wr.Stack[i].Mutex.Lock()
+			_, ok := wr.Stack[i].Stack[key]
+			wr.Stack[i].Mutex.Unlock()
+
+			if ok {
+				return wr.Stack[i], nil
 			}
 		}
 	}
@@ -1165,27 +992,51 @@ func (wrConn *webrtConnection) Key() string {
 	return fmt.Sprintf("webrtc:%d:%d:%d", wrConn.WItem.WHub.Key, wrConn.WItem.Key, wrConn.KeyI)
 }
 
+func (wrConn *webrtConnection) SendTo(key string, data any) {
+	WebrtcSend(key, data)
+}
+
+// Send sends the data to the connection with the key.
+//
+// Deprecated: use SendTo, or SendMessage for this connection.
 func (wrConn *webrtConnection) Send(key string, data any) {
-	wr, err := Webrtc()
+	WebrtcSend(key, data)
+}
 
-	if err != nil {
-		return
+func (wrConn *webrtConnection) SendAll(data any) {
+	WebrtcSendAll(data)
+}
+
+// SendMessage sends the message over the data channel of the connection.
+func (wrConn *webrtConnection) SendMessage(data any) bool {
+	if wrConn.DataChannel == nil {
+		return false
 	}
 
-	wr.Send(key, data)
+	var databytes []byte
+
+	components.СonvertAssign(&databytes, data)
+
+	return wrConn.DataChannel.Send(databytes) == nil
 }
 
-func (wrConn *webrtConnection) SendAll(data any) {
-	wr, err := Webrtc()
+func (wrConn *webrtConnection) Transport() string {
+	return controllers.PresenceTransportWebrtc
+}
 
-	if err != nil {
-		return
+func (wrConn *webrtConnection) User() uint64 {
+	return wrConn.UserId
+}
+
+func (wrConn *webrtConnection) Close() {
+	if wrConn.DataChannel != nil {
+		wrConn.DataChannel.Close()
 	}
 
-	wr.SendAll(data)
+	wrConn.Connection.Close()
 }
 
-func (wr *WebrtcApi) Send(key string, data any) {
+func (wr *WebrtcApi) Send(key string, data any) bool {
 	splitKey := strings.Split(key, ":")
 
 	if len(splitKey) == 4 {
@@ -1193,15 +1044,17 @@ func (wr *WebrtcApi) Send(key string, data any) {
 			if wHubKey, err := strconv.ParseUint(splitKey[1], 10, 64); err == nil {
 				if wItemKey, err := strconv.ParseUint(splitKey[2], 10, 64); err == nil {
 					if wConnKeyI, err := strconv.ParseUint(splitKey[3], 10, 64); err == nil {
-						if _, ok := wr.Stack[wHubKey]; ok {
-							if _, ok := wr.Stack[wHubKey].Stack[wItemKey]; ok {
-								if _, ok := wr.Stack[wHubKey].Stack[wItemKey].Connections[wConnKeyI]; ok {
-									if wr.Stack[wHubKey].Stack[wItemKey].Connections[wConnKeyI].DataChannel != nil {
+						if wHub, ok := wr.Stack[wHubKey]; ok {
+							if wItem := wHub.item(wItemKey); wItem != nil {
+								if wrConn := wItem.conn(wConnKeyI); wrConn != nil {
+									if wrConn.DataChannel != nil {
 										var databytes []byte
 
 										components.СonvertAssign(&databytes, data)
 
-										wr.Stack[wHubKey].Stack[wItemKey].Connections[wConnKeyI].DataChannel.Send(databytes)
+										wrConn.DataChannel.Send(databytes)
+
+										return true
 									}
 								}
 							}
@@ -1211,6 +1064,8 @@ func (wr *WebrtcApi) Send(key string, data any) {
 			}
 		}
 	}
+
+	return false
 }
 
 func (wr *WebrtcApi) SendAll(data any) {
@@ -1218,12 +1073,12 @@ func (wr *WebrtcApi) SendAll(data any) {
 
 	components.СonvertAssign(&databytes, data)
 
-	for wHubKey, _ := range wr.Stack {
-		for wItemKey, _ := range wr.Stack[wHubKey].Stack {
-			if wItemKey > 1000 {
-				for wConnKeyI, _ := range wr.Stack[wHubKey].Stack[wItemKey].Connections {
-					if wr.Stack[wHubKey].Stack[wItemKey].Connections[wConnKeyI].DataChannel != nil {
-						wr.Stack[wHubKey].Stack[wItemKey].Connections[wConnKeyI].DataChannel.Send(databytes)
+	for _, wHub := range wr.Stack {
+		for _, wItem := range wHub.items() {
+			if wItem.Key > 1000 {
+				for _, wrConn := range wItem.conns() {
+					if wrConn.DataChannel != nil {
+						wrConn.DataChannel.Send(databytes)
 					}
 				}
 			}
@@ -1234,19 +1089,149 @@ func (wr *WebrtcApi) SendAll(data any) {
 func WebrtcSendAll(data any) {
 	wr, err := Webrtc()
 
+	if err == nil {
+		wr.SendAll(data)
+	}
+
+	controllers.BackplanePublish(controllers.NewBackplaneMessage("webrtc", controllers.BackplaneActionAll, "", 0, data))
+}
+
+func WebrtcSend(key string, data any) {
+	wr, err := Webrtc()
+
+	// A connection of another node is reached through the backplane
+	if err != nil || !wr.Send(key, data) {
+		controllers.BackplanePublish(controllers.NewBackplaneMessage("webrtc", controllers.BackplaneActionKey, key, 0, data))
+	}
+}
+
+// WebrtcBackplaneReceive delivers a message published by another node.
+func WebrtcBackplaneReceive(bpMessage *controllers.BackplaneMessage) {
+	wr, err := Webrtc()
+
 	if err != nil {
 		return
 	}
 
-	wr.SendAll(data)
+	switch bpMessage.Action {
+	case controllers.BackplaneActionAll:
+		wr.SendAll(bpMessage.Data)
+	case controllers.BackplaneActionKey:
+		wr.Send(bpMessage.Key, bpMessage.Data)
+	}
 }
 
-func WebrtcSend(key string, data any) {
+// WebrtcDrain tells every data channel to reconnect and closes the peer connections.
+func WebrtcDrain(ctx context.Context) {
 	wr, err := Webrtc()
 
 	if err != nil {
 		return
 	}
 
-	wr.Send(key, data)
+	json := simplejson.New()
+	json.Set("event", controllers.DrainReconnect)
+	json.Set("retry", int64(config.DrainRetry/time.Millisecond))
+
+	message, _ := json.MarshalJSON()
+
+	connections := []*webrtConnection{}
+
+	for _, wHub := range wr.Stack {
+		wHub.Mutex.Lock()
+		for _, wItem := range wHub.Stack {
+			wItem.Mutex.Lock()
+			for _, wrConn := range wItem.Connections {
+				connections = append(connections, wrConn)
+			}
+			wItem.Mutex.Unlock()
+		}
+		wHub.Mutex.Unlock()
+	}
+
+	for _, wrConn := range connections {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if wrConn.DataChannel != nil {
+			wrConn.DataChannel.SendText(string(message))
+			wrConn.DataChannel.Close()
+		}
+
+		wrConn.Connection.Close()
+	}
+}
+
+// WebrtcConnections lists and controls the peer connections for the admin.
+func WebrtcConnections() *controllers.ConnectionsProvider {
+	return &controllers.ConnectionsProvider{
+		List: func() []*controllers.ConnectionInfo {
+			connections := []*controllers.ConnectionInfo{}
+
+			wr, err := Webrtc()
+			if err != nil {
+				return connections
+			}
+
+			for _, wHub := range wr.Stack {
+				for _, wItem := range wHub.items() {
+					wItem.Mutex.Lock()
+					for _, wrConn := range wItem.Connections {
+						connections = append(connections, &controllers.ConnectionInfo{
+							Transport: controllers.PresenceTransportWebrtc,
+							Key:       wrConn.Key(),
+							Ip:        wrConn.Ip,
+							UserId:    wrConn.UserId,
+							ConnectAt: wrConn.ConnectAt,
+							ActiveAt:  time.Unix(atomic.LoadInt64(&wrConn.Time), 0),
+						})
+					}
+					wItem.Mutex.Unlock()
+				}
+			}
+
+			return connections
+		},
+		Disconnect: func(key string) bool {
+			wrConn := webrtcConnection(key)
+			if wrConn == nil {
+				return false
+			}
+
+			wrConn.Close()
+
+			return true
+		},
+		Send: func(key string, message string) bool {
+			wr, err := Webrtc()
+			if err != nil {
+				return false
+			}
+
+			return wr.Send(key, message)
+		},
+	}
+}
+
+func webrtcConnection(key string) *webrtConnection {
+	wr, err := Webrtc()
+	if err != nil {
+		return nil
+	}
+
+	for _, wHub := range wr.Stack {
+		for _, wItem := range wHub.items() {
+			wItem.Mutex.Lock()
+			for _, wrConn := range wItem.Connections {
+				if wrConn.Key() == key {
+					wItem.Mutex.Unlock()
+					return wrConn
+				}
+			}
+			wItem.Mutex.Unlock()
+		}
+	}
+
+	return nil
 }
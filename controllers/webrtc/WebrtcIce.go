@@ -0,0 +1,271 @@
+package webrtc
+
+import (
+	"backnet/components"
+	"backnet/config"
+	"backnet/controllers"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// How long an answer without trickle waits for the ICE gathering
+const WebrtcGatherTimeout = 5 * time.Second
+
+// How long a poll of the local candidates waits for a new one
+const WebrtcCandidateWait = 10 * time.Second
+
+// WebrtcIceServer is an ICE server in the form of RTCIceServer of the browsers.
+type WebrtcIceServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+type webrtcIceStruct struct {
+	turn  *TurnServer
+	mutex sync.RWMutex
+}
+
+var webrtcIceApp webrtcIceStruct
+
+// WebrtcTurn adds the built-in TURN server to the ICE servers.
+func WebrtcTurn(ts *TurnServer) {
+	webrtcIceApp.mutex.Lock()
+	defer webrtcIceApp.mutex.Unlock()
+
+	webrtcIceApp.turn = ts
+}
+
+// WebrtcIceServers returns the ICE servers of the WEBRTC_ICE_* settings and of
+// the built-in TURN server for the browser of the user. The browsers get the
+// same list in the pages and in the answers. With TURN_SERVER_SECRET only the
+// authorized users get the TURN server, with credentials of TurnCredentialTtl.
+func WebrtcIceServers(userId uint64) []WebrtcIceServer {
+	return webrtcIceServers(userId, false)
+}
+
+func webrtcIceServers(userId uint64, server bool) []WebrtcIceServer {
+	iceServers := []WebrtcIceServer{}
+
+	for _, url := range config.WebrtcIceServers {
+		iceServer := WebrtcIceServer{
+			URLs: []string{url},
+		}
+
+		if strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:") {
+			iceServer.Username = config.WebrtcIceUsername
+			iceServer.Credential = config.WebrtcIceCredential
+		}
+
+		iceServers = append(iceServers, iceServer)
+	}
+
+	webrtcIceApp.mutex.RLock()
+	ts := webrtcIceApp.turn
+	webrtcIceApp.mutex.RUnlock()
+
+	if ts != nil {
+		if len(ts.Secret) == 0 {
+			iceServers = append(iceServers, ts.IceServers(ts.User())...)
+		} else if userId > 0 || server {
+			iceServers = append(iceServers, ts.IceServers(ts.Credentials(userId, config.TurnCredentialTtl))...)
+		}
+	}
+
+	return iceServers
+}
+
+// WebrtcTurnCredentials issues time-limited credentials of the built-in TURN server for the user.
+func WebrtcTurnCredentials(userId uint64) (string, string, error) {
+	webrtcIceApp.mutex.RLock()
+	ts := webrtcIceApp.turn
+	webrtcIceApp.mutex.RUnlock()
+
+	if ts == nil || len(ts.Secret) == 0 {
+		return "", "", fmt.Errorf("TURN credentials are not enabled")
+	}
+
+	username, credential := ts.Credentials(userId, config.TurnCredentialTtl)
+
+	return username, credential, nil
+}
+
+// webrtcConfiguration is the configuration of the peer connections of the server.
+func webrtcConfiguration() webrtc.Configuration {
+	iceServers := []webrtc.ICEServer{}
+
+	for _, iceServer := range webrtcIceServers(0, true) {
+		iceServers = append(iceServers, webrtc.ICEServer{
+			URLs:       iceServer.URLs,
+			Username:   iceServer.Username,
+			Credential: iceServer.Credential,
+		})
+	}
+
+	return webrtc.Configuration{
+		ICEServers: iceServers,
+	}
+}
+
+// answer answers the offer of the request on the connection. With "trickle"
+// the answer goes back at once and the candidates are exchanged later by the
+// session key and token, otherwise it goes back when the ICE gathering is
+// complete, with all the candidates in it.
+func (wrConn *webrtConnection) answer(WObj *webrtObj, values map[string]any) error {
+	offer := webrtc.SessionDescription{}
+	var local_session string
+
+	components.СonvertAssign(&local_session, WObj.Data.Get("local_session"))
+
+	components.Decode(local_session, &offer)
+
+	trickle := WObj.Data.Is("trickle")
+
+	wrConn.Mutex.Lock()
+	wrConn.Token = components.RandString(32)
+	wrConn.candidateChan = make(chan struct{})
+
+	if signal, ok := WObj.Data.Get("signal").(*controllers.WebsocketClient); ok {
+		wrConn.Signal = signal
+	}
+	wrConn.Mutex.Unlock()
+
+	wrConn.Connection.OnICECandidate(wrConn.iceCandidate)
+
+	gatherComplete := webrtc.GatheringCompletePromise(wrConn.Connection)
+
+	// Set the remote SessionDescription
+	if err := wrConn.Connection.SetRemoteDescription(offer); err != nil {
+		return err
+	}
+
+	// Create an answer
+	answer, err := wrConn.Connection.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+
+	// Sets the LocalDescription, and starts our UDP listeners
+	if err := wrConn.Connection.SetLocalDescription(answer); err != nil {
+		return err
+	}
+
+	send := func() {
+		if WObj.OpenChanSource {
+			wResp := &webrtResp{
+				Action: "SessionDescription",
+				Data:   components.NewData(),
+			}
+
+			wResp.Data.Set("remote_session", components.Encode(*wrConn.Connection.LocalDescription()))
+			wResp.Data.Set("session", wrConn.Key())
+			wResp.Data.Set("token", wrConn.Token)
+			wResp.Data.Set("trickle", trickle)
+
+			for key, value := range values {
+				wResp.Data.Set(key, value)
+			}
+
+			WObj.SendChanSource(wResp)
+
+			WObj.CloseChanSource()
+		}
+	}
+
+	go func() {
+		if !trickle {
+			select {
+			case <-gatherComplete:
+			case <-time.After(WebrtcGatherTimeout):
+			}
+		}
+
+		send()
+	}()
+
+	return nil
+}
+
+// iceCandidate keeps the local candidates for the polls, nil is the end of the
+// gathering. The candidates of a signaled session go to its websocket client.
+func (wrConn *webrtConnection) iceCandidate(c *webrtc.ICECandidate) {
+	wrConn.signalMutex.Lock()
+	defer wrConn.signalMutex.Unlock()
+
+	wrConn.Mutex.Lock()
+
+	if wrConn.signaled {
+		wsClient := wrConn.Signal
+		wrConn.Mutex.Unlock()
+
+		if c == nil {
+			wrConn.signalCandidates(wsClient, []*webrtc.ICECandidateInit{nil})
+		} else {
+			candidate := c.ToJSON()
+			wrConn.signalCandidates(wsClient, []*webrtc.ICECandidateInit{&candidate})
+		}
+		return
+	}
+	defer wrConn.Mutex.Unlock()
+
+	if c == nil {
+		wrConn.gathered = true
+	} else {
+		wrConn.candidates = append(wrConn.candidates, c.ToJSON())
+	}
+
+	close(wrConn.candidateChan)
+	wrConn.candidateChan = make(chan struct{})
+}
+
+// VerifyToken checks the token of the session given in its answer.
+func (wrConn *webrtConnection) VerifyToken(token string) bool {
+	wrConn.Mutex.Lock()
+	defer wrConn.Mutex.Unlock()
+
+	return wrConn.Token != "" && subtle.ConstantTimeCompare([]byte(wrConn.Token), []byte(token)) == 1
+}
+
+// Candidates returns the local candidates gathered since the last call and
+// whether the gathering is complete. It waits up to wait for a new candidate.
+func (wrConn *webrtConnection) Candidates(wait time.Duration) ([]webrtc.ICECandidateInit, bool) {
+	wrConn.Mutex.Lock()
+
+	if len(wrConn.candidates) == 0 && !wrConn.gathered && wrConn.candidateChan != nil {
+		candidateChan := wrConn.candidateChan
+		wrConn.Mutex.Unlock()
+
+		select {
+		case <-candidateChan:
+		case <-time.After(wait):
+		}
+
+		wrConn.Mutex.Lock()
+	}
+
+	candidates := wrConn.candidates
+	wrConn.candidates = nil
+
+	if candidates == nil {
+		candidates = []webrtc.ICECandidateInit{}
+	}
+
+	gathered := wrConn.gathered
+	wrConn.Mutex.Unlock()
+
+	return candidates, gathered
+}
+
+// AddCandidate adds a remote candidate of the session, an empty one is the end of the candidates.
+func (wrConn *webrtConnection) AddCandidate(candidate webrtc.ICECandidateInit) error {
+	if wrConn.Connection.RemoteDescription() == nil {
+		return fmt.Errorf("Session has no offer")
+	}
+
+	return wrConn.Connection.AddICECandidate(candidate)
+}
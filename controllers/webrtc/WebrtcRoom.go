@@ -0,0 +1,577 @@
+package webrtc
+
+import (
+	"backnet/components"
+	"backnet/config"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// How long a viewer of a publisher waits for its first track
+const WebrtcRoomTrackWait = 5 * time.Second
+
+// webrtRoom is a named room of camera streams: several publishers send their
+// tracks and a viewer gets the tracks of one publisher or of all of them. The
+// connections of the room are kept in its item of the hub.
+type webrtRoom struct {
+	Mutex      sync.Mutex
+	Name       string
+	WHub       *webrtHub
+	WItem      *webrtItem
+	Publishers map[uint64]*webrtPublisher
+	Viewers    map[uint64]*webrtViewer
+	CreateAt   time.Time
+	EmptyAt    time.Time
+	Done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// webrtPublisher forwards the tracks of a publisher, keyed by the remote track
+// id, to the viewers. The stream id of the tracks is the publisher key.
+type webrtPublisher struct {
+	Conn      *webrtConnection
+	Tracks    map[string]*webrtc.TrackLocalStaticRTP
+	Ready     chan struct{}
+	readyOnce sync.Once
+}
+
+// webrtViewer plays the publisher with the key, all the publishers for "".
+type webrtViewer struct {
+	Conn      *webrtConnection
+	Publisher string
+}
+
+// WebrtcRoomInfo describes a room for the list of rooms.
+type WebrtcRoomInfo struct {
+	Name       string    `json:"name"`
+	Publishers []string  `json:"publishers"`
+	Viewers    int       `json:"viewers"`
+	CreateAt   time.Time `json:"create_at"`
+}
+
+// Rooms are created one at a time, so that a name is in one hub only
+var webrtcRoomsMutex sync.Mutex
+
+// WebrtcRoom returns the room with the name, nil if there is none.
+func WebrtcRoom(name string) *webrtRoom {
+	wr, err := Webrtc()
+	if err != nil {
+		return nil
+	}
+
+	for _, wHub := range wr.Stack {
+		wHub.Mutex.Lock()
+		room, ok := wHub.Rooms[name]
+		wHub.Mutex.Unlock()
+
+		if ok {
+			return room
+		}
+	}
+
+	return nil
+}
+
+// WebrtcRoomCreate returns the room with the name, a new one in the least
+// loaded hub if there is none and the node has less than WebrtcRoomMax.
+func WebrtcRoomCreate(name string) (*webrtRoom, error) {
+	if name == "" {
+		return nil, fmt.Errorf("Room name is empty")
+	}
+
+	webrtcRoomsMutex.Lock()
+	defer webrtcRoomsMutex.Unlock()
+
+	if room := WebrtcRoom(name); room != nil {
+		return room, nil
+	}
+
+	if config.WebrtcRoomMax > 0 && len(WebrtcRooms()) >= config.WebrtcRoomMax {
+		return nil, fmt.Errorf("Too many rooms")
+	}
+
+	wrHub, err := WebrtHub()
+	if err != nil {
+		return nil, err
+	}
+
+	return wrHub.newRoom(name), nil
+}
+
+// webrtcPublishRoom returns the room of a publisher, only an authorized user creates a new one.
+func webrtcPublishRoom(name string, userId uint64) (*webrtRoom, error) {
+	if userId == 0 {
+		if room := WebrtcRoom(name); room != nil {
+			return room, nil
+		}
+
+		return nil, fmt.Errorf("Room not found")
+	}
+
+	return WebrtcRoomCreate(name)
+}
+
+// WebrtcRoomClose closes the room and all its connections.
+func WebrtcRoomClose(name string) bool {
+	if room := WebrtcRoom(name); room != nil {
+		room.close()
+
+		return true
+	}
+
+	return false
+}
+
+// WebrtcRooms returns the rooms of this node sorted by name.
+func WebrtcRooms() []*WebrtcRoomInfo {
+	rooms := []*WebrtcRoomInfo{}
+
+	wr, err := Webrtc()
+	if err != nil {
+		return rooms
+	}
+
+	for _, wHub := range wr.Stack {
+		wHub.Mutex.Lock()
+		for _, room := range wHub.Rooms {
+			rooms = append(rooms, room.info())
+		}
+		wHub.Mutex.Unlock()
+	}
+
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Name < rooms[j].Name
+	})
+
+	return rooms
+}
+
+func (wrHub *webrtHub) newRoom(name string) *webrtRoom {
+	key := atomic.AddUint64(&webrtcApp.I, 1)
+
+	wrObj := NewWebrtObj()
+	wrObj.Action = "cameraVideoStream"
+	wrObj.Data.Set("key", key)
+	wrObj.Data.Set("room", name)
+
+	room := &webrtRoom{
+		Name: name,
+		WHub: wrHub,
+		WItem: &webrtItem{
+			Key:          key,
+			WHub:         wrHub,
+			WObj:         wrObj,
+			OfferChan:    make(chan *webrtObj),
+			CompleteChan: make(chan error),
+			Connections:  map[uint64]*webrtConnection{},
+		},
+		Publishers: map[uint64]*webrtPublisher{},
+		Viewers:    map[uint64]*webrtViewer{},
+		CreateAt:   time.Now(),
+		EmptyAt:    time.Now(),
+		Done:       make(chan struct{}),
+	}
+
+	room.WItem.Room = room
+
+	wrHub.Mutex.Lock()
+	wrHub.Stack[key] = room.WItem
+	wrHub.Rooms[name] = room
+	wrHub.Count++
+	wrHub.Mutex.Unlock()
+
+	go room.run()
+
+	return room
+}
+
+// run closes the room when it has been empty for WebrtcRoomEmptyTimeout.
+func (room *webrtRoom) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-room.Done:
+			return
+		case <-ticker.C:
+			room.Mutex.Lock()
+			empty := len(room.Publishers) == 0 && len(room.Viewers) == 0 && time.Since(room.EmptyAt) >= config.WebrtcRoomEmptyTimeout
+			room.Mutex.Unlock()
+
+			if empty {
+				room.close()
+				return
+			}
+		}
+	}
+}
+
+func (room *webrtRoom) close() {
+	room.closeOnce.Do(func() {
+		close(room.Done)
+
+		room.WHub.Mutex.Lock()
+		if room.WHub.Rooms[room.Name] == room {
+			delete(room.WHub.Rooms, room.Name)
+		}
+		delete(room.WHub.Stack, room.WItem.Key)
+		room.WHub.Count--
+		room.WHub.Mutex.Unlock()
+
+		room.Mutex.Lock()
+		keys := []uint64{}
+
+		for key := range room.Publishers {
+			keys = append(keys, key)
+		}
+
+		for key := range room.Viewers {
+			keys = append(keys, key)
+		}
+
+		room.Publishers = map[uint64]*webrtPublisher{}
+		room.Viewers = map[uint64]*webrtViewer{}
+		room.Mutex.Unlock()
+
+		for _, key := range keys {
+			room.WItem.delConn(key)
+		}
+	})
+}
+
+func (room *webrtRoom) info() *WebrtcRoomInfo {
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+
+	info := &WebrtcRoomInfo{
+		Name:       room.Name,
+		Publishers: []string{},
+		Viewers:    len(room.Viewers),
+		CreateAt:   room.CreateAt,
+	}
+
+	for _, publisher := range room.Publishers {
+		info.Publishers = append(info.Publishers, publisher.Conn.Key())
+	}
+
+	sort.Strings(info.Publishers)
+
+	return info
+}
+
+func (room *webrtRoom) newConnection(WObj *webrtObj) (*webrtConnection, error) {
+	// Create a new RTCPeerConnection
+	peerConnection, err := webrtc.NewPeerConnection(webrtcConfiguration())
+	if err != nil {
+		return nil, err
+	}
+
+	webrtConnection := room.WItem.NewWebrtConnection(peerConnection, WObj)
+
+	webrtConnection.Connection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		fmt.Printf("Peer Connection State has changed: %s\n", s.String())
+
+		if s == webrtc.PeerConnectionStateDisconnected || s == webrtc.PeerConnectionStateFailed || s == webrtc.PeerConnectionStateClosed {
+			room.leave(webrtConnection.KeyI)
+		}
+	})
+
+	return webrtConnection, nil
+}
+
+// leave removes the publisher or the viewer from the room.
+func (room *webrtRoom) leave(keyI uint64) {
+	room.Mutex.Lock()
+	publisher, isPublisher := room.Publishers[keyI]
+	_, isViewer := room.Viewers[keyI]
+
+	delete(room.Publishers, keyI)
+	delete(room.Viewers, keyI)
+
+	if (isPublisher || isViewer) && len(room.Publishers) == 0 && len(room.Viewers) == 0 {
+		room.EmptyAt = time.Now()
+	}
+
+	tracks := map[webrtc.TrackLocal]bool{}
+	viewers := []*webrtConnection{}
+
+	if isPublisher {
+		for _, track := range publisher.Tracks {
+			tracks[track] = true
+		}
+
+		for _, viewer := range room.Viewers {
+			if viewer.Publisher == "" || viewer.Publisher == publisher.Conn.Key() {
+				viewers = append(viewers, viewer.Conn)
+			}
+		}
+	}
+	room.Mutex.Unlock()
+
+	if isPublisher || isViewer {
+		room.WItem.delConn(keyI)
+	}
+
+	for _, viewer := range viewers {
+		go room.unpublish(viewer, tracks)
+	}
+}
+
+// unpublish removes the tracks of a publisher that left from the viewer and
+// sends it an offer of the server without them.
+func (room *webrtRoom) unpublish(viewer *webrtConnection, tracks map[webrtc.TrackLocal]bool) {
+	removed := false
+
+	for _, rtpSender := range viewer.Connection.GetSenders() {
+		if track := rtpSender.Track(); track != nil && tracks[track] {
+			if err := viewer.Connection.RemoveTrack(rtpSender); err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			removed = true
+		}
+	}
+
+	if removed && viewer.signal() != nil {
+		if err := viewer.Offer(); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+func (room *webrtRoom) publisher(keyI uint64) *webrtPublisher {
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+
+	return room.Publishers[keyI]
+}
+
+// publish receives the tracks of a new publisher of the room.
+func (room *webrtRoom) publish(WObj *webrtObj) {
+	webrtConnection, err := room.newConnection(WObj)
+	if err != nil {
+		fmt.Println(err)
+		WObj.CloseChanSource()
+		return
+	}
+
+	publisher := &webrtPublisher{
+		Conn:   webrtConnection,
+		Tracks: map[string]*webrtc.TrackLocalStaticRTP{},
+		Ready:  make(chan struct{}),
+	}
+
+	room.Mutex.Lock()
+	room.Publishers[webrtConnection.KeyI] = publisher
+	room.Mutex.Unlock()
+
+	webrtConnection.Connection.OnTrack(func(remoteTrack *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		// Send a PLI on an interval so that the publisher is pushing a keyframe for the new viewers
+		go func() {
+			ticker := time.NewTicker(time.Second * 3)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				if room.publisher(webrtConnection.KeyI) == nil {
+					return
+				}
+
+				if rtcpSendErr := webrtConnection.Connection.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(remoteTrack.SSRC())}}); rtcpSendErr != nil {
+					fmt.Println(rtcpSendErr)
+				}
+			}
+		}()
+
+		fmt.Printf("Track has started, of type %d: %s \n", remoteTrack.PayloadType(), remoteTrack.Codec().RTPCodecCapability.MimeType)
+
+		// Create a local track, all the viewers of the publisher will be fed via this track
+		localTrack, newTrackErr := webrtc.NewTrackLocalStaticRTP(remoteTrack.Codec().RTPCodecCapability, remoteTrack.ID(), webrtConnection.Key())
+		if newTrackErr != nil {
+			fmt.Println(newTrackErr)
+			return
+		}
+
+		room.Mutex.Lock()
+		publisher.Tracks[remoteTrack.ID()] = localTrack
+		room.Mutex.Unlock()
+
+		publisher.readyOnce.Do(func() {
+			close(publisher.Ready)
+		})
+
+		go room.push(localTrack)
+
+		rtpBuf := make([]byte, 1400)
+		for {
+			i, _, readErr := remoteTrack.Read(rtpBuf)
+			if readErr != nil {
+				fmt.Println(readErr)
+				return
+			}
+
+			// ErrClosedPipe means we don't have any subscribers, this is ok if no peers have connected yet
+			if _, err := localTrack.Write(rtpBuf[:i]); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+				fmt.Println(err)
+				return
+			}
+		}
+	})
+
+	room.answer(WObj, webrtConnection, map[string]any{
+		"room":      room.Name,
+		"publisher": webrtConnection.Key(),
+	})
+}
+
+// push adds the new track of a publisher to the viewers of all the publishers
+// that have a signaling channel and sends them an offer of the server.
+func (room *webrtRoom) push(track webrtc.TrackLocal) {
+	room.Mutex.Lock()
+	viewers := []*webrtConnection{}
+
+	for _, viewer := range room.Viewers {
+		if viewer.Publisher == "" {
+			viewers = append(viewers, viewer.Conn)
+		}
+	}
+	room.Mutex.Unlock()
+
+	for _, viewer := range viewers {
+		if viewer.signal() == nil {
+			continue
+		}
+
+		if err := addTrack(viewer, track); err != nil {
+			fmt.Println(err)
+			continue
+		}
+
+		if err := viewer.Offer(); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// tracks returns the tracks of the publisher with the key, of all the
+// publishers for "". It waits for the first track of a new publisher.
+func (room *webrtRoom) tracks(publisherKey string) ([]webrtc.TrackLocal, error) {
+	room.Mutex.Lock()
+	publishers := []*webrtPublisher{}
+
+	for _, publisher := range room.Publishers {
+		if publisherKey == "" || publisher.Conn.Key() == publisherKey {
+			publishers = append(publishers, publisher)
+		}
+	}
+	room.Mutex.Unlock()
+
+	if publisherKey != "" {
+		if len(publishers) == 0 {
+			return nil, fmt.Errorf("Publisher not found")
+		}
+
+		select {
+		case <-publishers[0].Ready:
+		case <-time.After(WebrtcRoomTrackWait):
+		}
+	}
+
+	room.Mutex.Lock()
+	defer room.Mutex.Unlock()
+
+	traks := []webrtc.TrackLocal{}
+
+	for _, publisher := range publishers {
+		for _, track := range publisher.Tracks {
+			traks = append(traks, track)
+		}
+	}
+
+	if len(traks) == 0 {
+		return nil, fmt.Errorf("Camera no set")
+	}
+
+	return traks, nil
+}
+
+// subscribe sends the tracks of the chosen publisher (Data "publisher"), or of
+// all the publishers, to a new viewer. The offer of the viewer needs a
+// transceiver for every track.
+func (room *webrtRoom) subscribe(WObj *webrtObj) {
+	var publisherKey string
+	components.СonvertAssign(&publisherKey, WObj.Data.Get("publisher"))
+
+	// A viewer of all the publishers with a signaling channel gets the new tracks with offers of the server
+	traks, err := room.tracks(publisherKey)
+	if err != nil && !(publisherKey == "" && WObj.Data.Is("signal")) {
+		wResp := &webrtResp{
+			Action: "Error",
+			Data:   components.NewData(),
+		}
+
+		wResp.Data.Set("error", err.Error())
+
+		WObj.SendChanSource(wResp)
+
+		WObj.CloseChanSource()
+		return
+	}
+
+	webrtConnection, err := room.newConnection(WObj)
+	if err != nil {
+		fmt.Println(err)
+		WObj.CloseChanSource()
+		return
+	}
+
+	room.Mutex.Lock()
+	room.Viewers[webrtConnection.KeyI] = &webrtViewer{
+		Conn:      webrtConnection,
+		Publisher: publisherKey,
+	}
+	room.Mutex.Unlock()
+
+	for i := range traks {
+		addTrack(webrtConnection, traks[i])
+	}
+
+	room.answer(WObj, webrtConnection, map[string]any{
+		"room": room.Name,
+	})
+}
+
+func (room *webrtRoom) answer(WObj *webrtObj, webrtConnection *webrtConnection, values map[string]any) {
+	if err := webrtConnection.answer(WObj, values); err != nil {
+		fmt.Println(err)
+		WObj.CloseChanSource()
+		room.leave(webrtConnection.KeyI)
+	}
+}
+
+func addTrack(webrtConnection *webrtConnection, track webrtc.TrackLocal) error {
+	rtpSender, err := webrtConnection.Connection.AddTrack(track)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		rtcpBuf := make([]byte, 1500)
+		for {
+			if _, _, rtcpErr := rtpSender.Read(rtcpBuf); rtcpErr != nil {
+				return
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,486 @@
+package webrtc
+
+import (
+	"backnet/components"
+	"backnet/controllers"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// The signaling of the WebRTC sessions over the websocket rpc:
+//
+//	webrtc.offer      client → server {action, sdp, room, publisher}: a new session, acked with {session, sdp, ice_servers}.
+//	                  client → server {session, sdp}: a renegotiation of the session, acked with {session, sdp}.
+//	                  server → client {session, sdp}: an offer of the server, acked with {sdp}.
+//	webrtc.candidate  both ways {session, candidate}, a null candidate is the end of the candidates.
+//	webrtc.hangup     both ways {session}.
+//
+// The actions are the ones of the POST routes: video, camera, publish, play
+// and channels. The sessions trickle and are closed with the websocket client.
+type webrtcSignal struct {
+	Action    string                     `json:"action,omitempty"`
+	Session   string                     `json:"session,omitempty"`
+	Sdp       *webrtc.SessionDescription `json:"sdp,omitempty"`
+	Candidate *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+	Room      string                     `json:"room,omitempty"`
+	Publisher string                     `json:"publisher,omitempty"`
+
+	// The ICE servers of the answer of a new session
+	IceServers []WebrtcIceServer `json:"ice_servers,omitempty"`
+}
+
+type webrtcSignalingStruct struct {
+	rpc   *controllers.WebsocketRpc
+	mutex sync.RWMutex
+}
+
+var webrtcSignalingApp webrtcSignalingStruct
+
+// WebrtcSignaling serves the signaling on the websocket rpc.
+func WebrtcSignaling(rpc *controllers.WebsocketRpc) {
+	webrtcSignalingApp.mutex.Lock()
+	webrtcSignalingApp.rpc = rpc
+	webrtcSignalingApp.mutex.Unlock()
+
+	rpc.On("webrtc.offer", webrtcSignalOffer)
+	rpc.On("webrtc.candidate", webrtcSignalCandidate)
+	rpc.On("webrtc.hangup", webrtcSignalHangup)
+}
+
+// WebrtcSignalingClose closes the sessions of the websocket client.
+func WebrtcSignalingClose(wsClient *controllers.WebsocketClient) {
+	wr, err := Webrtc()
+	if err != nil {
+		return
+	}
+
+	connections := []*webrtConnection{}
+
+	for _, wHub := range wr.Stack {
+		wHub.Mutex.Lock()
+		for _, wItem := range wHub.Stack {
+			wItem.Mutex.Lock()
+			for _, wrConn := range wItem.Connections {
+				wrConn.Mutex.Lock()
+				if wrConn.Signal == wsClient {
+					wrConn.Signal = nil
+					connections = append(connections, wrConn)
+				}
+				wrConn.Mutex.Unlock()
+			}
+			wItem.Mutex.Unlock()
+		}
+		wHub.Mutex.Unlock()
+	}
+
+	for _, wrConn := range connections {
+		wrConn.Hangup()
+	}
+}
+
+func webrtcSignalRpc() *controllers.WebsocketRpc {
+	webrtcSignalingApp.mutex.RLock()
+	defer webrtcSignalingApp.mutex.RUnlock()
+
+	return webrtcSignalingApp.rpc
+}
+
+// webrtcSignalConnection returns the session of the websocket client.
+func webrtcSignalConnection(wsClient *controllers.WebsocketClient, session string) (*webrtConnection, error) {
+	if wrConn := webrtcConnection(session); wrConn != nil {
+		wrConn.Mutex.Lock()
+		defer wrConn.Mutex.Unlock()
+
+		if wrConn.Signal == wsClient {
+			return wrConn, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Session not found")
+}
+
+func webrtcSignalOffer(request *controllers.WebsocketRpcRequest) {
+	signal := &webrtcSignal{}
+
+	if err := request.Bind(signal); err != nil || signal.Sdp == nil {
+		request.Error(fmt.Errorf("sdp not"))
+		return
+	}
+
+	if signal.Session != "" {
+		wrConn, err := webrtcSignalConnection(request.Client, signal.Session)
+		if err != nil {
+			request.Error(err)
+			return
+		}
+
+		answer, err := wrConn.Renegotiate(*signal.Sdp)
+		if err != nil {
+			request.Error(err)
+			return
+		}
+
+		request.Ack(&webrtcSignal{
+			Session: signal.Session,
+			Sdp:     &answer,
+		})
+		return
+	}
+
+	wrObj := NewWebrtObj()
+
+	wrObj.Data.Set("local_session", components.Encode(*signal.Sdp))
+	wrObj.Data.Set("trickle", true)
+	wrObj.Data.Set("signal", request.Client)
+	wrObj.Data.Set("ip", request.Client.Ip)
+
+	if request.Client.UserId > 0 {
+		wrObj.Data.Set("user_id", request.Client.UserId)
+	}
+
+	var wrHub *webrtHub
+	var err error
+
+	switch signal.Action {
+	case "video":
+		wrObj.Action = "storageVideoStream"
+
+		wrObj.Data.Set("key", StorageVideoStream)
+		wrObj.Data.Set("audio", "storage/video/output.ogg")
+		wrObj.Data.Set("video", "storage/video/output.ivf")
+
+		wrHub, err = WebrtHubByObj(wrObj)
+	case "camera":
+		wrObj.Action = "cameraVideoSave"
+
+		wrObj.Data.Set("file_out", "tmp/webrtc/video.webm")
+		wrObj.Data.Set("max_time", 60*10*time.Second)
+
+		wrHub, err = WebrtHubByObj(wrObj)
+	case "publish", "play":
+		var room *webrtRoom
+
+		if signal.Action == "publish" {
+			room, err = webrtcPublishRoom(signal.Room, request.Client.UserId)
+		} else if room = WebrtcRoom(signal.Room); room == nil {
+			err = fmt.Errorf("Room not found")
+		}
+
+		if err == nil {
+			wrObj.Action = "cameraVideoStream"
+
+			wrObj.Data.Set("key", room.WItem.Key)
+			wrObj.Data.Set("room", room.Name)
+			wrObj.Data.Set("publisher", signal.Publisher)
+
+			if signal.Action == "publish" {
+				wrObj.Data.Set("action.set", true)
+			} else {
+				wrObj.Data.Set("action.get", true)
+			}
+
+			wrHub = room.WHub
+		}
+	case "channels":
+		wrObj.Action = "WebrtcChannelsSessionGet"
+
+		wrHub, err = WebrtHubByObj(wrObj)
+	default:
+		err = fmt.Errorf("unknown action %s", signal.Action)
+	}
+
+	if err != nil {
+		request.Error(err)
+		return
+	}
+
+	// The session waits for the worker of the hub, out of the read loop of the client
+	request.Go(func() {
+		webrtcSignalSession(request, wrHub, wrObj)
+	})
+}
+
+// webrtcSignalSession opens the new session of an offer and acks it with the answer.
+func webrtcSignalSession(request *controllers.WebsocketRpcRequest, wrHub *webrtHub, wrObj *webrtObj) {
+	wrHub.ChanStack <- wrObj
+
+	select {
+	case wrResp, ok := <-wrObj.ChanSource:
+		if !ok {
+			request.Error(fmt.Errorf("Session closed"))
+			return
+		}
+
+		if wrResp.Action == "Error" {
+			request.Error(fmt.Errorf("%v", wrResp.Data.Get("error")))
+			return
+		}
+
+		var remote_session, session string
+
+		components.СonvertAssign(&remote_session, wrResp.Data.Get("remote_session"))
+		components.СonvertAssign(&session, wrResp.Data.Get("session"))
+
+		answer := webrtc.SessionDescription{}
+		components.Decode(remote_session, &answer)
+
+		ack := &webrtcSignal{
+			Session:    session,
+			Sdp:        &answer,
+			IceServers: WebrtcIceServers(request.Client.UserId),
+		}
+
+		if wrResp.Data.Is("room") {
+			components.СonvertAssign(&ack.Room, wrResp.Data.Get("room"))
+		}
+
+		if wrResp.Data.Is("publisher") {
+			components.СonvertAssign(&ack.Publisher, wrResp.Data.Get("publisher"))
+		}
+
+		request.Ack(ack)
+
+		// The candidates go after the answer
+		if wrConn := webrtcConnection(session); wrConn != nil {
+			wrConn.signalStart()
+		}
+	case <-time.After(10 * time.Second):
+		wrObj.CloseChanSource()
+		request.Error(fmt.Errorf("Session timed out"))
+	}
+}
+
+func webrtcSignalCandidate(request *controllers.WebsocketRpcRequest) {
+	signal := &webrtcSignal{}
+
+	if err := request.Bind(signal); err != nil {
+		request.Error(err)
+		return
+	}
+
+	wrConn, err := webrtcSignalConnection(request.Client, signal.Session)
+	if err != nil {
+		request.Error(err)
+		return
+	}
+
+	candidate := webrtc.ICECandidateInit{}
+
+	if signal.Candidate != nil {
+		candidate = *signal.Candidate
+	}
+
+	if err := wrConn.AddCandidate(candidate); err != nil {
+		request.Error(err)
+	}
+}
+
+func webrtcSignalHangup(request *controllers.WebsocketRpcRequest) {
+	signal := &webrtcSignal{}
+
+	if err := request.Bind(signal); err != nil {
+		request.Error(err)
+		return
+	}
+
+	wrConn, err := webrtcSignalConnection(request.Client, signal.Session)
+	if err != nil {
+		request.Error(err)
+		return
+	}
+
+	wrConn.Mutex.Lock()
+	wrConn.Signal = nil
+	wrConn.Mutex.Unlock()
+
+	wrConn.Hangup()
+}
+
+// Hangup closes the session, a session of a room leaves the room.
+func (wrConn *webrtConnection) Hangup() {
+	if wrConn.WItem.Room != nil {
+		wrConn.WItem.Room.leave(wrConn.KeyI)
+	} else {
+		wrConn.WItem.delConn(wrConn.KeyI)
+	}
+}
+
+// Renegotiate answers a new offer of the browser for the session. An offer
+// that collides with the one of the server is refused, the browser rolls its
+// offer back when it gets the one of the server.
+func (wrConn *webrtConnection) Renegotiate(offer webrtc.SessionDescription) (webrtc.SessionDescription, error) {
+	wrConn.offerMutex.Lock()
+	defer wrConn.offerMutex.Unlock()
+
+	if wrConn.Connection.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		return webrtc.SessionDescription{}, fmt.Errorf("Offer collides with the offer of the server")
+	}
+
+	if err := wrConn.Connection.SetRemoteDescription(offer); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+
+	answer, err := wrConn.Connection.CreateAnswer(nil)
+	if err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+
+	if err := wrConn.Connection.SetLocalDescription(answer); err != nil {
+		return webrtc.SessionDescription{}, err
+	}
+
+	return *wrConn.Connection.LocalDescription(), nil
+}
+
+// Offer sends an offer of the server to the websocket client of the session,
+// for the tracks added after the answer, and sets the answer of the browser.
+// The tracks added while an offer waits for its answer go in one more offer.
+func (wrConn *webrtConnection) Offer() error {
+	wsClient := wrConn.signal()
+	rpc := webrtcSignalRpc()
+
+	if wsClient == nil || rpc == nil {
+		return fmt.Errorf("Session has no signaling")
+	}
+
+	wrConn.offerMutex.Lock()
+	if wrConn.offering {
+		wrConn.offerAgain = true
+		wrConn.offerMutex.Unlock()
+
+		return nil
+	}
+	wrConn.offering = true
+	wrConn.offerMutex.Unlock()
+
+	for {
+		err := wrConn.offer(rpc, wsClient)
+
+		wrConn.offerMutex.Lock()
+		if err != nil || !wrConn.offerAgain {
+			wrConn.offering = false
+			wrConn.offerAgain = false
+			wrConn.offerMutex.Unlock()
+
+			return err
+		}
+		wrConn.offerAgain = false
+		wrConn.offerMutex.Unlock()
+	}
+}
+
+func (wrConn *webrtConnection) offer(rpc *controllers.WebsocketRpc, wsClient *controllers.WebsocketClient) error {
+	wrConn.offerMutex.Lock()
+
+	offer, err := wrConn.Connection.CreateOffer(nil)
+	if err == nil {
+		err = wrConn.Connection.SetLocalDescription(offer)
+	}
+
+	sdp := wrConn.Connection.LocalDescription()
+	wrConn.offerMutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	// The answer is read by the read loop of the websocket client, which
+	// renegotiates on the offers of the browser
+	data, err := rpc.Request(wsClient, "webrtc.offer", &webrtcSignal{
+		Session: wrConn.Key(),
+		Sdp:     sdp,
+	}, 0)
+
+	answer := &webrtcSignal{}
+
+	if err == nil {
+		if json.Unmarshal(data, answer) != nil || answer.Sdp == nil {
+			err = fmt.Errorf("Offer has no answer")
+		}
+	}
+
+	if err != nil {
+		// The connection stays in have-local-offer, pion can not roll the offer back
+		wrConn.Hangup()
+
+		return err
+	}
+
+	wrConn.offerMutex.Lock()
+	defer wrConn.offerMutex.Unlock()
+
+	return wrConn.Connection.SetRemoteDescription(*answer.Sdp)
+}
+
+// signal returns the websocket client of the signaling of the session.
+func (wrConn *webrtConnection) signal() *controllers.WebsocketClient {
+	wrConn.Mutex.Lock()
+	defer wrConn.Mutex.Unlock()
+
+	return wrConn.Signal
+}
+
+// signalStart sends the candidates gathered before the answer, the next ones go at once.
+func (wrConn *webrtConnection) signalStart() {
+	wrConn.signalMutex.Lock()
+	defer wrConn.signalMutex.Unlock()
+
+	wrConn.Mutex.Lock()
+
+	if wrConn.Signal == nil || wrConn.signaled {
+		wrConn.Mutex.Unlock()
+		return
+	}
+
+	wrConn.signaled = true
+
+	wsClient := wrConn.Signal
+	candidates := []*webrtc.ICECandidateInit{}
+
+	for i := range wrConn.candidates {
+		candidates = append(candidates, &wrConn.candidates[i])
+	}
+
+	wrConn.candidates = nil
+
+	if wrConn.gathered {
+		candidates = append(candidates, nil)
+	}
+	wrConn.Mutex.Unlock()
+
+	wrConn.signalCandidates(wsClient, candidates)
+}
+
+// signalCandidates sends the local candidates to the websocket client, nil is
+// the end of the gathering. wrConn.signalMutex is held, wrConn.Mutex is not.
+func (wrConn *webrtConnection) signalCandidates(wsClient *controllers.WebsocketClient, candidates []*webrtc.ICECandidateInit) {
+	rpc := webrtcSignalRpc()
+
+	if rpc == nil || wsClient == nil {
+		return
+	}
+
+	for _, candidate := range candidates {
+		rpc.Emit(wsClient.Key(), "webrtc.candidate", map[string]any{
+			"session":   wrConn.Key(),
+			"candidate": candidate,
+		})
+	}
+}
+
+func (wrConn *webrtConnection) signalHangup() {
+	wrConn.Mutex.Lock()
+	wsClient := wrConn.Signal
+	wrConn.Signal = nil
+	wrConn.Mutex.Unlock()
+
+	if rpc := webrtcSignalRpc(); rpc != nil && wsClient != nil {
+		rpc.Emit(wsClient.Key(), "webrtc.hangup", &webrtcSignal{
+			Session: wrConn.Key(),
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package webrtc
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Run with -race: the admin lists and looks up the connections while the
+// sessions of the hub open and close.
+func TestWebrtcConnectionsRace(t *testing.T) {
+	t.Setenv("WEBRTC_SERVER_CONNECT", "true")
+
+	wrHub, err := WebrtHub()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < 20; j++ {
+				wrObj := NewWebrtObj()
+				wrObj.Action = "test"
+				wrObj.Data.Set("key", uint64(1000000+i*1000+j))
+				wrObj.Data.Set("ip", "127.0.0.1")
+
+				peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				wItem := wrHub.webrtItemByObj(wrObj)
+				wrConn := wItem.NewWebrtConnection(peerConnection, wrObj)
+
+				if j%2 == 0 {
+					wItem.delConn(wrConn.KeyI)
+				}
+			}
+		}(i)
+	}
+
+	done := make(chan struct{})
+	listed := make(chan struct{})
+
+	go func() {
+		defer close(listed)
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			for _, info := range WebrtcConnections().List() {
+				webrtcConnection(info.Key)
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	<-listed
+
+	for _, info := range WebrtcConnections().List() {
+		if webrtcConnection(info.Key) == nil {
+			t.Errorf("Connection %s not found", info.Key)
+		}
+	}
+}
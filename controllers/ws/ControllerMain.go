@@ -2,18 +2,27 @@ package ws
 
 import (
 	"backnet/config"
-	"fmt"
 	"net/http"
 
 	"backnet/controllers"
+
+	"github.com/gorilla/websocket"
 )
 
 type ControllerMain struct {
 	controllers.Controller
+	Rpc *controllers.WebsocketRpc
+
+	// The text messages that are not rpc are passed to the handler of all transports
+	Handler controllers.ConnectionHandler
 }
 
-func NewControllerMain() ControllerMain {
+func NewControllerMain(handler controllers.ConnectionHandler) ControllerMain {
 	controller := ControllerMain{}
+	controller.Handler = handler
+
+	controller.Rpc = controllers.NewWebsocketRpc(controller.OnRawMessage)
+	controller.Rpc.On("echo", controller.OnEcho)
 
 	return controller
 }
@@ -38,14 +47,25 @@ func (сontroller ControllerMain) Index(w http.ResponseWriter, r *http.Request)
 }
 
 func (сontroller ControllerMain) OnConnect(wsClient *controllers.WebsocketClient) {
-	controllers.WebsocketSendAll(fmt.Sprint("connection registered: ", wsClient.Key()))
+	сontroller.Handler.OnConnect(wsClient)
+}
+
+func (сontroller ControllerMain) OnMessage(wsClient *controllers.WebsocketClient, messageType int, message []byte) {
+	сontroller.Rpc.OnMessage(wsClient, messageType, message)
+}
+
+func (сontroller ControllerMain) OnEcho(request *controllers.WebsocketRpcRequest) {
+	request.Ack(request.Data)
 }
 
-func (сontroller ControllerMain) OnMessage(wsClient *controllers.WebsocketClient, message []byte) {
-	controllers.WebsocketSend(wsClient.Key(), "send...")
-	controllers.WebsocketSendAll(message)
+func (сontroller ControllerMain) OnRawMessage(wsClient *controllers.WebsocketClient, messageType int, message []byte) {
+	if messageType == websocket.BinaryMessage {
+		wsClient.SendAllBinary(message)
+	} else {
+		сontroller.Handler.OnMessage(wsClient, message)
+	}
 }
 
 func (сontroller ControllerMain) OnClose(wsClient *controllers.WebsocketClient) {
-	controllers.WebsocketSendAll(fmt.Sprint("connection unregistered: ", wsClient.Key()))
+	сontroller.Handler.OnClose(wsClient)
 }
@@ -15,7 +15,8 @@ import (
 func (route Route) Http(router *mux.Router) {
 	adminControllerAuth := admin.NewControllerAuth()
 	adminControllerMain := admin.NewControllerMain()
-	wsControllerMain := ws.NewControllerMain()
+	adminControllerConnections := admin.NewControllerConnections()
+	wsControllerMain := ws.NewControllerMain(realtimeHandler)
 	sseControllerMain := sse.NewControllerMain()
 
 	frontendControllerMain := frontend.NewControllerMain()
@@ -30,6 +31,9 @@ func (route Route) Http(router *mux.Router) {
 	router.Name("admin.auth.authorize").Methods("POST").Path("/admin/authorize").HandlerFunc(adminControllerAuth.Authorize)
 	router.Name("admin.auth.logout").Methods("GET").Path("/admin/logout").HandlerFunc(adminControllerAuth.Logout)
 	router.Name("admin.auth.monitor").Path("/admin/monitor").HandlerFunc(adminControllerMain.Monitor())
+	router.Name("admin.connections").Methods("GET").Path("/admin/connections").HandlerFunc(adminControllerConnections.List)
+	router.Name("admin.connections.disconnect").Methods("POST").Path("/admin/connections/disconnect").HandlerFunc(adminControllerConnections.Disconnect)
+	router.Name("admin.connections.send").Methods("POST").Path("/admin/connections/send").HandlerFunc(adminControllerConnections.Send)
 
 	router.Name("main.index").Methods("GET").Path("/").HandlerFunc(frontendControllerMain.Index)
 
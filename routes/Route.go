@@ -1,6 +1,13 @@
 package routes
 
+import (
+	"backnet/controllers/realtime"
+)
+
 type Route struct {
 }
 
 var App Route
+
+// The application handler of the websocket, SSE and WebRTC data channel clients
+var realtimeHandler = realtime.NewControllerMain()
@@ -4,19 +4,18 @@ import (
 	"github.com/gorilla/mux"
 
 	"backnet/controllers"
-	"backnet/controllers/sse"
 )
 
 func (route Route) Sse(router *mux.Router) {
-	sseControllerMain := sse.NewControllerMain()
-
 	sseApi, err := controllers.SseApi()
 
-	sseApi.OnConnect = sseControllerMain.OnConnect
-	sseApi.OnMessage = sseControllerMain.OnMessage
-	sseApi.OnClose = sseControllerMain.OnClose
+	controllers.BackplaneHandle("sse", controllers.SseBackplaneReceive)
+	controllers.DrainHandle("sse", controllers.SseDrain)
+	controllers.ConnectionsHandle("sse", controllers.SseConnections())
 
 	if err == nil {
-		router.Name("sse.connect").Methods("GET").Path("/sse").HandlerFunc(sseApi.SseHandler)
+		sseApi.Handle(realtimeHandler)
+
+		router.Name("sse.connect").Methods("GET").Path("/sse").HandlerFunc(controllers.DrainGuard(sseApi.SseHandler))
 	}
 }
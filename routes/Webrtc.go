@@ -1,6 +1,7 @@
 package routes
 
 import (
+	"backnet/controllers"
 	"backnet/controllers/webrtc"
 
 	"github.com/gorilla/mux"
@@ -9,15 +10,28 @@ import (
 func (route Route) Webrtc(router *mux.Router) {
 	controllerWebrtc := webrtc.NewControllerMain()
 
+	controllers.BackplaneHandle("webrtc", webrtc.WebrtcBackplaneReceive)
+	controllers.DrainHandle("webrtc", webrtc.WebrtcDrain)
+	controllers.ConnectionsHandle("webrtc", webrtc.WebrtcConnections())
+	webrtc.WebrtcHandle(realtimeHandler)
+
 	router.Name("webrtc.video.index").Methods("GET").Path("/video").HandlerFunc(controllerWebrtc.Index)
-	router.Name("webrtc.video.webrtc.session.get").Methods("POST").Path("/video/webrtc/session/get").HandlerFunc(controllerWebrtc.WebrtcSessionGet)
+	router.Name("webrtc.video.webrtc.session.get").Methods("POST").Path("/video/webrtc/session/get").HandlerFunc(controllers.DrainGuard(controllerWebrtc.WebrtcSessionGet))
+
+	router.Name("webrtc.video.webrtc.candidate.add").Methods("POST").Path("/video/webrtc/candidate/add").HandlerFunc(controllerWebrtc.WebrtcCandidateAdd)
+	router.Name("webrtc.video.webrtc.candidate.get").Methods("POST").Path("/video/webrtc/candidate/get").HandlerFunc(controllerWebrtc.WebrtcCandidateGet)
+
+	router.Name("webrtc.video.webrtc.turn.credentials").Methods("GET").Path("/video/webrtc/turn/credentials").HandlerFunc(controllerWebrtc.WebrtcTurnCredentials)
 
 	router.Name("webrtc.video.cam").Methods("GET").Path("/cam").HandlerFunc(controllerWebrtc.Cam)
-	router.Name("webrtc.video.webrtc.camera.set").Methods("POST").Path("/video/webrtc/camera/set").HandlerFunc(controllerWebrtc.WebrtcCameraSet)
+	router.Name("webrtc.video.webrtc.camera.set").Methods("POST").Path("/video/webrtc/camera/set").HandlerFunc(controllers.DrainGuard(controllerWebrtc.WebrtcCameraSet))
 	router.Name("webrtc.video.cam.stream").Methods("GET").Path("/cam/stream").HandlerFunc(controllerWebrtc.CamStream)
-	router.Name("webrtc.video.webrtc.camera.stream.set").Methods("POST").Path("/video/webrtc/camera/stream/set").HandlerFunc(controllerWebrtc.WebrtcCameraStreamSet)
-	router.Name("webrtc.video.webrtc.camera.stream.get").Methods("POST").Path("/video/webrtc/camera/stream/get").HandlerFunc(controllerWebrtc.WebrtcCameraStreamGet)
+	router.Name("webrtc.video.webrtc.camera.stream.set").Methods("POST").Path("/video/webrtc/camera/stream/set").HandlerFunc(controllers.DrainGuard(controllerWebrtc.WebrtcCameraStreamSet))
+	router.Name("webrtc.video.webrtc.camera.stream.get").Methods("POST").Path("/video/webrtc/camera/stream/get").HandlerFunc(controllers.DrainGuard(controllerWebrtc.WebrtcCameraStreamGet))
+	router.Name("webrtc.video.webrtc.rooms").Methods("GET").Path("/video/webrtc/rooms").HandlerFunc(controllerWebrtc.WebrtcRooms)
+	router.Name("webrtc.video.webrtc.room.create").Methods("POST").Path("/video/webrtc/room/create").HandlerFunc(controllers.DrainGuard(controllerWebrtc.WebrtcRoomCreate))
+	router.Name("webrtc.video.webrtc.room.close").Methods("POST").Path("/video/webrtc/room/close").HandlerFunc(controllerWebrtc.WebrtcRoomClose)
 
 	router.Name("webrtc.channels.index").Methods("GET").Path("/channels/index").HandlerFunc(controllerWebrtc.WebrtcChannelsIndex)
-	router.Name("webrtc.channels.session.get").Methods("POST").Path("/webrtc/channels/session/get").HandlerFunc(controllerWebrtc.WebrtcChannelsSessionGet)
+	router.Name("webrtc.channels.session.get").Methods("POST").Path("/webrtc/channels/session/get").HandlerFunc(controllers.DrainGuard(controllerWebrtc.WebrtcChannelsSessionGet))
 }
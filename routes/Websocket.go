@@ -1,57 +1,69 @@
 package routes
 
 import (
-	"bytes"
 	"log"
 	"net/http"
-	"strings"
-	"time"
+	"strconv"
 
 	"backnet/config"
 	"backnet/controllers"
+	"backnet/controllers/webrtc"
 	"backnet/controllers/ws"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 )
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
-
-var originHosts []string = []string{}
-
 var wsCtrl *controllers.Websocket
 
 func (route Route) Websocket(router *mux.Router) {
-	if config.Env("WS_CHECK_ORIGN") == "true" || config.Env("WS_CHECK_ORIGN") == "1" {
-		upgrader.CheckOrigin = func(r *http.Request) bool {
-			return true
+	wsControllerMain := ws.NewControllerMain(realtimeHandler)
+
+	controllers.BackplaneHandle("ws", controllers.WebsocketBackplaneReceive)
+	controllers.DrainHandle("ws", controllers.WebsocketDrain)
+	controllers.ConnectionsHandle("ws", controllers.WebsocketConnections())
+	if wsCtrl == nil {
+		var err error
+
+		webrtc.WebrtcSignaling(wsControllerMain.Rpc)
+
+		wsCtrl, err = controllers.NewWebsocket("main", 1000000, wsControllerMain.OnConnect, wsControllerMain.OnMessage, func(wsClient *controllers.WebsocketClient) {
+			webrtc.WebrtcSignalingClose(wsClient)
+			wsControllerMain.OnClose(wsClient)
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if config.Env("WS_AUTH") == "true" || config.Env("WS_AUTH") == "1" {
+			wsCtrl.Auth = true
 		}
-	} else if len(originHosts) > 0 {
-		upgrader.CheckOrigin = func(r *http.Request) bool {
-			for i, _ := range originHosts {
-				if originHosts[i] == r.Header.Get("Origin") {
-					return true
-				}
-			}
 
-			return false
+		if config.Env("WS_FILTER_NEWLINE") == "true" || config.Env("WS_FILTER_NEWLINE") == "1" {
+			wsCtrl.FuncFilter = controllers.WebsocketFilterNewline
 		}
+
+		wsCtrl.Upgrader = wsCtrl.Config.Upgrader(controllers.CorsPolicy().CheckOrigin)
 	}
 
-	wsControllerMain := ws.NewControllerMain()
-	if wsCtrl == nil {
-		wsCtrl = controllers.NewWebsocket(1000000, wsControllerMain.OnConnect, wsControllerMain.OnMessage, wsControllerMain.OnClose)
+	router.Name("websocket.ws").Methods("GET").Path("/ws").HandlerFunc(controllers.DrainGuard(websocketHandler(wsCtrl)))
+}
+
+// websocketHandler serves the connections of the hub, every hub has its own route.
+func websocketHandler(wsCtrl *controllers.Websocket) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		request := controllers.NewRequest(w, r)
 
-		if !(config.Env("WS_CHECK_ORIGN") == "true" || config.Env("WS_CHECK_ORIGN") == "false" || config.Env("WS_CHECK_ORIGN") == "1" || config.Env("WS_CHECK_ORIGN") == "0") && len(config.Env("WS_CHECK_ORIGN")) > 0 {
-			originHosts = strings.Split(config.Env("WS_CHECK_ORIGN"), ",")
+		if !request.Valid {
+			return
+		}
+
+		if wsCtrl.Auth && !request.IsAuth() {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
 		}
-	}
 
-	router.Name("websocket.ws").Methods("GET").Path("/ws").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		conn, err := upgrader.Upgrade(w, r, nil)
+		conn, err := wsCtrl.Upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			log.Println(err)
 			return
@@ -59,18 +71,30 @@ func (route Route) Websocket(router *mux.Router) {
 
 		wsClient, err := wsCtrl.NewWebsocketClient(conn)
 
+		if request.IsAuth() {
+			wsClient.UserId = uint64(request.User.Id.Get())
+		}
+
+		wsClient.Ip = controllers.RequestIp(r)
+
+		if wsCtrl.Replay != nil && r.URL.Query().Has("since") {
+			if since, err := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64); err == nil {
+				wsClient.Replay = true
+				wsClient.Since = since
+			}
+		}
+
 		wsCtrl.Register(wsClient)
 
 		defer func() {
 			wsCtrl.Unregister(wsClient)
-			wsClient.Connect.Close()
+			wsClient.Close()
 		}()
 
-		wsClient.Connect.SetReadLimit(config.MaxMessageSize)
-		wsClient.Connect.SetReadDeadline(time.Now().Add(config.PongWait))
-		wsClient.Connect.SetPongHandler(func(string) error { wsClient.Connect.SetReadDeadline(time.Now().Add(config.PongWait)); return nil })
+		wsCtrl.Config.Prepare(wsClient.Connect)
+
 		for {
-			_, message, err := wsClient.Connect.ReadMessage()
+			messageType, message, err := wsClient.Connect.ReadMessage()
 			if err != nil {
 				//fmt.Println("ERROR ReadMessage: ", err)
 
@@ -79,8 +103,10 @@ func (route Route) Websocket(router *mux.Router) {
 				}
 				break
 			}
-			message = bytes.TrimSpace(bytes.Replace(message, []byte{'\n'}, []byte{' '}, -1))
-			wsCtrl.Broadcast(wsClient, message)
+
+			if !wsCtrl.Broadcast(wsClient, messageType, message) {
+				break
+			}
 		}
-	})
+	}
 }
@@ -3,11 +3,13 @@ package main
 import (
 	"log"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"backnet/components"
 	"backnet/config"
+	"backnet/controllers"
 	"backnet/controllers/webrtc"
 	"backnet/routes"
 
@@ -42,11 +44,132 @@ func main() {
 			if config.PongWait > 0 {
 				config.PingPeriod = int64((config.PongWait * 9) / 10)
 			} else {
-				config.PingPeriod = 50
+				config.PingPeriod = int64(50 * time.Second)
 			}
 		}
 	}
 
+	if n := config.EnvInt("WS_WRITE_WAIT", 0); n > 0 {
+		config.WriteWait = time.Duration(n) * time.Second
+	}
+
+	if n := config.EnvInt("WS_MAX_MESSAGE_SIZE", 0); n > 0 {
+		config.MaxMessageSize = int64(n)
+	}
+
+	config.WsReadBufferSize = config.EnvInt("WS_READ_BUFFER_SIZE", config.WsReadBufferSize)
+	config.WsWriteBufferSize = config.EnvInt("WS_WRITE_BUFFER_SIZE", config.WsWriteBufferSize)
+	config.WsEnableCompression = config.EnvBool("WS_COMPRESSION", config.WsEnableCompression)
+	config.WsCompressionLevel = config.EnvInt("WS_COMPRESSION_LEVEL", config.WsCompressionLevel)
+
+	if config.Env("WS_SEND_QUEUE_SIZE") != "" {
+		n, err := strconv.Atoi(config.Env("WS_SEND_QUEUE_SIZE"))
+		if err == nil && n > 0 {
+			config.WsSendQueueSize = n
+		}
+	}
+
+	if config.Env("WS_SEND_QUEUE_POLICY") != "" {
+		config.WsSendQueuePolicy = config.Env("WS_SEND_QUEUE_POLICY")
+	}
+
+	if n := config.EnvInt("WS_SHARDS", 0); n > 0 {
+		config.WsShards = n
+	}
+
+	if n := config.EnvInt("WS_MAX_SHARDS", 0); n > 0 {
+		config.WsMaxShards = n
+	}
+
+	if n := config.EnvInt("WS_STACK_SIZE", 0); n > 0 {
+		config.WsStackSize = uint64(n)
+	}
+
+	for _, replay := range strings.Split(config.Env("WS_REPLAY"), ",") {
+		switch strings.TrimSpace(replay) {
+		case "all":
+			config.WsReplayAll = true
+		case "room", "rooms":
+			config.WsReplayRooms = true
+		}
+	}
+
+	config.WsReplaySize = config.EnvInt("WS_REPLAY_SIZE", config.WsReplaySize)
+
+	if n := config.EnvInt("WS_REPLAY_MAX_AGE", 0); n > 0 {
+		config.WsReplayMaxAge = time.Duration(n) * time.Second
+	}
+
+	if n := config.EnvInt("DRAIN_RETRY", 0); n > 0 {
+		config.DrainRetry = time.Duration(n) * time.Second
+	}
+
+	config.WsRate = config.EnvFloat("WS_RATE", config.WsRate)
+	config.WsRateBurst = config.EnvInt("WS_RATE_BURST", config.WsRateBurst)
+	config.WsRateIp = config.EnvFloat("WS_RATE_IP", config.WsRateIp)
+	config.WsRateIpBurst = config.EnvInt("WS_RATE_IP_BURST", config.WsRateIpBurst)
+	config.WsRatePolicy = config.GetEnv("WS_RATE_POLICY", config.WsRatePolicy)
+
+	config.SseRate = config.EnvFloat("SSE_RATE", config.SseRate)
+	config.SseRateBurst = config.EnvInt("SSE_RATE_BURST", config.SseRateBurst)
+	config.SseRateIp = config.EnvFloat("SSE_RATE_IP", config.SseRateIp)
+	config.SseRateIpBurst = config.EnvInt("SSE_RATE_IP_BURST", config.SseRateIpBurst)
+	config.SseRatePolicy = config.GetEnv("SSE_RATE_POLICY", config.SseRatePolicy)
+
+	config.SseHistorySize = config.EnvInt("SSE_HISTORY_SIZE", config.SseHistorySize)
+
+	if n := config.EnvInt("SSE_HISTORY_MAX_AGE", 0); n > 0 {
+		config.SseHistoryMaxAge = time.Duration(n) * time.Second
+	}
+
+	if n := config.EnvInt("SSE_TOKEN_TTL", 0); n > 0 {
+		config.SseTokenTtl = time.Duration(n) * time.Second
+	}
+
+	config.CorsOrigins = config.EnvList("CORS_ORIGINS", config.CorsOrigins)
+
+	// WS_CHECK_ORIGN is the origin check of the websockets before CORS_ORIGINS
+	if checkOrigin := config.Env("WS_CHECK_ORIGN"); checkOrigin != "" && config.Env("CORS_ORIGINS") == "" {
+		if checkOrigin == "true" || checkOrigin == "1" {
+			config.CorsOrigins = []string{"*"}
+		} else if checkOrigin != "false" && checkOrigin != "0" {
+			config.CorsOrigins = config.EnvList("WS_CHECK_ORIGN", config.CorsOrigins)
+		}
+
+		log.Println("WS_CHECK_ORIGN is deprecated, use CORS_ORIGINS")
+	}
+
+	config.CorsMethods = config.EnvList("CORS_METHODS", config.CorsMethods)
+	config.CorsHeaders = config.EnvList("CORS_HEADERS", config.CorsHeaders)
+	config.CorsCredentials = config.EnvBool("CORS_CREDENTIALS", config.CorsCredentials)
+	config.CorsMaxAge = config.EnvInt("CORS_MAX_AGE", config.CorsMaxAge)
+
+	// Any origin with the credentials would give the cookies of the users to every site
+	if config.CorsCredentials {
+		for _, origin := range config.CorsOrigins {
+			if origin == "*" {
+				log.Fatal("CORS_CREDENTIALS needs a list of the origins in CORS_ORIGINS, not *")
+			}
+		}
+	}
+
+	if n := config.EnvInt("WEBRTC_ROOM_EMPTY_TIMEOUT", 0); n > 0 {
+		config.WebrtcRoomEmptyTimeout = time.Duration(n) * time.Second
+	}
+
+	config.WebrtcRoomMax = config.EnvInt("WEBRTC_ROOM_MAX", config.WebrtcRoomMax)
+
+	if _, ok := os.LookupEnv("WEBRTC_ICE_SERVERS"); ok {
+		config.WebrtcIceServers = config.EnvList("WEBRTC_ICE_SERVERS", []string{})
+	}
+
+	config.WebrtcIceUsername = config.GetEnv("WEBRTC_ICE_USERNAME", config.WebrtcIceUsername)
+	config.WebrtcIceCredential = config.GetEnv("WEBRTC_ICE_CREDENTIAL", config.WebrtcIceCredential)
+
+	if n := config.EnvInt("TURN_SERVER_CREDENTIAL_TTL", 0); n > 0 {
+		config.TurnCredentialTtl = time.Duration(n) * time.Second
+	}
+
 	_, err := components.DB()
 
 	if err != nil {
@@ -55,6 +178,21 @@ func main() {
 
 	defer components.CloseDB()
 
+	if err := controllers.BackplaneStart(); err != nil {
+		log.Fatal(err)
+	}
+
+	defer controllers.BackplaneClose()
+
+	cors := controllers.CorsPolicy()
+	sseCors := cors
+
+	// The SSE streams answered any origin before CORS_ORIGINS, the pages of
+	// HTTP_PORT open them on SSE_PORT
+	if len(config.CorsOrigins) == 0 {
+		sseCors = controllers.NewCors([]string{"*"}, config.CorsMethods, config.CorsHeaders, false, config.CorsMaxAge)
+	}
+
 	MuxRouterHTTP := components.RouteMux("http")
 	MuxRouterWs := components.RouteMux("ws")
 	MuxRouterSse := components.RouteMux("sse")
@@ -97,7 +235,7 @@ func main() {
 
 	if config.Env("HTTP_SERVER_START") == "true" || config.Env("HTTP_SERVER_START") == "1" {
 		srv = &http.Server{
-			Handler: MuxRouterHTTP,
+			Handler: cors.Handler(MuxRouterHTTP),
 			//Handler: controllers.RedirectToHTTPSRouter(MuxRouterHTTP), // Редирект на https
 			Addr: ":" + config.Env("HTTP_PORT"),
 			// Good practice: enforce timeouts for servers you create!
@@ -116,7 +254,7 @@ func main() {
 
 	if config.Env("HTTPS_SERVER_START") == "true" || config.Env("HTTPS_SERVER_START") == "1" {
 		srvTLS = &http.Server{
-			Handler: MuxRouterHTTP,
+			Handler: cors.Handler(MuxRouterHTTP),
 			Addr:    ":" + config.Env("HTTPS_PORT"),
 
 			WriteTimeout: time.Second * 15,
@@ -134,7 +272,7 @@ func main() {
 	if config.Env("HTTP_PORT") != config.Env("WS_PORT") {
 		if config.Env("WS_SERVER_START") == "true" || config.Env("WS_SERVER_START") == "1" {
 			srvWs = &http.Server{
-				Handler: MuxRouterWs,
+				Handler: cors.Handler(MuxRouterWs),
 				//Handler: controllers.RedirectToHTTPSRouter(MuxRouterHTTP), // Редирект на https
 				Addr: ":" + config.Env("WS_PORT"),
 				// Good practice: enforce timeouts for servers you create!
@@ -155,7 +293,7 @@ func main() {
 	if config.Env("HTTPS_PORT") != config.Env("WSS_PORT") {
 		if config.Env("WSS_SERVER_START") == "true" || config.Env("WSS_SERVER_START") == "1" {
 			srvWss = &http.Server{
-				Handler: MuxRouterWs,
+				Handler: cors.Handler(MuxRouterWs),
 				//Handler: controllers.RedirectToHTTPSRouter(MuxRouterHTTP), // Редирект на https
 				Addr: ":" + config.Env("WSS_PORT"),
 				// Good practice: enforce timeouts for servers you create!
@@ -176,7 +314,7 @@ func main() {
 	if config.Env("HTTP_PORT") != config.Env("SSE_PORT") {
 		if config.Env("WS_SERVER_START") == "true" || config.Env("WS_SERVER_START") == "1" {
 			srvSse = &http.Server{
-				Handler: MuxRouterSse,
+				Handler: sseCors.Handler(MuxRouterSse),
 				//Handler: controllers.RedirectToHTTPSRouter(MuxRouterHTTP), // Редирект на https
 				Addr: ":" + config.Env("SSE_PORT"),
 				// Good practice: enforce timeouts for servers you create!
@@ -197,7 +335,7 @@ func main() {
 	if config.Env("HTTPS_PORT") != config.Env("SSES_PORT") {
 		if config.Env("WSS_SERVER_START") == "true" || config.Env("WSS_SERVER_START") == "1" {
 			srvSses = &http.Server{
-				Handler: MuxRouterSse,
+				Handler: sseCors.Handler(MuxRouterSse),
 				//Handler: controllers.RedirectToHTTPSRouter(MuxRouterHTTP), // Редирект на https
 				Addr: ":" + config.Env("SSES_PORT"),
 				// Good practice: enforce timeouts for servers you create!
@@ -228,7 +366,10 @@ func main() {
 			config.Env("TURN_SERVER_USERS"),
 			config.Env("TURN_SERVER_REALM"),
 			config.Env("TURN_SERVER_CERT_FILE"),
-			config.Env("TURN_SERVER_KEY_FILE"))
+			config.Env("TURN_SERVER_KEY_FILE"),
+			config.Env("TURN_SERVER_SECRET"))
+
+		webrtc.WebrtcTurn(turnServer)
 
 		go turnServer.Run()
 	}
@@ -246,6 +387,12 @@ func main() {
 	// Create a deadline to wait for.
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
 	defer cancel()
+
+	// Close the realtime connections first, Shutdown does not touch hijacked
+	// websockets and long-lived streams. The servers get what is left of the
+	// deadline.
+	controllers.Drain(ctx)
+
 	// Doesn't block if no connections, but will otherwise wait
 	// until the timeout deadline.
 	if srv != nil {